@@ -1,16 +1,39 @@
 module github.com/bitsbeats/prometheus-acls
 
-go 1.13
+go 1.22.0
 
 require (
 	github.com/coreos/go-oidc v2.1.0+incompatible
 	github.com/gorilla/sessions v1.2.0
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/prometheus/client_golang v1.20.3
+	github.com/prometheus/common v0.59.1
+	github.com/prometheus/prometheus v0.55.1
+	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.26.0
+	golang.org/x/oauth2 v0.23.0
+	golang.org/x/time v0.6.0
+	gopkg.in/square/go-jose.v2 v2.4.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dennwc/varint v1.0.0 // indirect
+	github.com/go-kit/log v0.2.1 // indirect
+	github.com/go-logfmt/logfmt v0.6.0 // indirect
+	github.com/gorilla/securecookie v1.1.1 // indirect
+	github.com/grafana/regexp v0.0.0-20240518133315-a468a5bfb3bc // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
-	github.com/prometheus/client_golang v1.2.1
-	github.com/prometheus/prometheus v1.8.2-0.20191111142012-edeb7a44cbf7
-	github.com/sirupsen/logrus v1.4.2
-	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6
-	gopkg.in/square/go-jose.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v2 v2.2.2
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	github.com/rogpeppe/go-internal v1.12.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+var lastUsedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "prometheus_acls_api_key_last_used_timestamp_seconds",
+	Help: "A Gauge that tracks the last time an api key has been used.",
+}, []string{"key"})
+
+func init() {
+	prometheus.MustRegister(lastUsedGauge)
+}
+
+type (
+	// KeyAuth authenticates service accounts with static api keys
+	KeyAuth struct {
+		cfg  *config.Config
+		keys map[string]*apiKey
+	}
+
+	// apiKey is a config.APIKey that remembers its last verified secret
+	apiKey struct {
+		*config.APIKey
+
+		mutex    sync.Mutex
+		verified []byte
+	}
+)
+
+// NewKeyAuth creates a new KeyAuth for the api keys of cfg
+func NewKeyAuth(cfg *config.Config) (a *KeyAuth, err error) {
+	if len(cfg.APIKeys) == 0 {
+		return nil, fmt.Errorf("unable to setup api key auth: no api keys configured in API_KEYS_FILE")
+	}
+	a = &KeyAuth{
+		cfg:  cfg,
+		keys: map[string]*apiKey{},
+	}
+	for name, key := range cfg.APIKeys {
+		a.keys[name] = &apiKey{APIKey: key}
+	}
+	return
+}
+
+// auth loads the api key of the current request. Keys are of the form <name>.<secret>
+// and sent as bearer token or in the APIKeyHeader
+func (a *KeyAuth) auth(r *http.Request) (key *apiKey, err error) {
+	token := r.Header.Get(a.cfg.APIKeyHeader)
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("unable to load api key: no api key in request")
+	}
+	name := strings.SplitN(token, ".", 2)[0]
+	key, ok := a.keys[name]
+	if !ok {
+		return nil, fmt.Errorf("unable to verify api key: unknown key")
+	}
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		return nil, fmt.Errorf("unable to verify api key: key %s expired", name)
+	}
+	if !key.verify(token) {
+		return nil, fmt.Errorf("unable to verify api key: invalid secret for key %s", name)
+	}
+	lastUsedGauge.WithLabelValues(name).SetToCurrentTime()
+	return key, nil
+}
+
+// verify checks the token against the hash of the key. The digest of the last valid
+// token is kept, so the expensive hash is only computed once
+func (k *apiKey) verify(token string) bool {
+	digest := sha256.Sum256([]byte(token))
+	k.mutex.Lock()
+	verified := k.verified
+	k.mutex.Unlock()
+	if verified != nil && subtle.ConstantTimeCompare(verified, digest[:]) == 1 {
+		return true
+	}
+
+	ok := false
+	if strings.HasPrefix(k.Hash, "$argon2") {
+		var err error
+		ok, err = compareArgon2(k.Hash, token)
+		if err != nil {
+			log.WithError(err).WithField("key", k.Name).Error("unable to verify api key")
+			return false
+		}
+	} else {
+		ok = bcrypt.CompareHashAndPassword([]byte(k.Hash), []byte(token)) == nil
+	}
+	if ok {
+		k.mutex.Lock()
+		k.verified = digest[:]
+		k.mutex.Unlock()
+	}
+	return ok
+}
+
+// compareArgon2 compares a argon2i or argon2id hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash> with password
+func compareArgon2(hash string, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("invalid argon2 hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %s", parts[2])
+	}
+	var memory, iterations uint32
+	var parallelism uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism)
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters %s: %s", parts[3], err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %s", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, fmt.Errorf("invalid argon2 hash: %v", err)
+	}
+
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, iterations, memory, parallelism, uint32(len(want)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant %s", parts[1])
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// loadACL returns the ACL of the first role of key that has an ACL
+func (a *KeyAuth) loadACL(key *apiKey) core.ACL {
+	claims := map[string]interface{}{
+		"sub": key.Name,
+	}
+	return aclForRoles(a.cfg, key.Roles, claims)
+}
+
+// Identify verifies the api key of the request
+func (a *KeyAuth) Identify(r *http.Request) (core.ACL, error) {
+	key, err := a.auth(r)
+	if err != nil {
+		return nil, err
+	}
+	// the api key is not forwarded
+	r.Header.Del(a.cfg.APIKeyHeader)
+	return a.loadACL(key), nil
+}
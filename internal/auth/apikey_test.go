@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+func TestKeyAuth(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("ci.secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("saltsaltsaltsalt")
+	argon2Hash := "$argon2id$v=19$m=1024,t=1,p=1$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("slo.secret"), salt, 1, 1024, 1, 32))
+
+	cfg := &config.Config{
+		APIKeyHeader: "X-API-Key",
+		ACLMap:       config.ACLMap{"developer": &config.ACL{Role: "developer"}},
+		APIKeys: config.APIKeyMap{
+			"ci":      {Name: "ci", Hash: string(bcryptHash), Roles: []string{"unknown", "developer"}},
+			"slo":     {Name: "slo", Hash: argon2Hash, Roles: []string{"developer"}},
+			"expired": {Name: "expired", Hash: string(bcryptHash), Roles: []string{"developer"}, Expires: time.Now().Add(-time.Hour)},
+		},
+	}
+	a, err := NewKeyAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChain([]NamedProvider{{Name: "apikey", Provider: a}})
+
+	tests := []struct {
+		header  string
+		value   string
+		subject string
+	}{
+		{header: "Authorization", value: "Bearer ci.secret", subject: "ci"},
+		{header: "X-API-Key", value: "ci.secret", subject: "ci"},
+		{header: "X-API-Key", value: "ci.secret", subject: "ci"},
+		{header: "X-API-Key", value: "slo.secret", subject: "slo"},
+		{header: "X-API-Key", value: "ci.wrong"},
+		{header: "X-API-Key", value: "slo.wrong"},
+		{header: "X-API-Key", value: "expired.secret"},
+		{header: "Authorization", value: "Bearer eyJhbGciOi.eyJzdWIiOi.c2ln"},
+		{header: "X-Other", value: "ci.secret"},
+	}
+	for _, test := range tests {
+		var subject string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			subject = r.Context().Value("acl").(core.IdentityACL).GetSubject()
+		})
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		req.Header.Set(test.header, test.value)
+		rec := httptest.NewRecorder()
+		c.Middleware(next).ServeHTTP(rec, req)
+		if test.subject == "" {
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("%s: %s must be rejected, got %d", test.header, test.value, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK || subject != test.subject {
+			t.Fatalf("%s: %s must be accepted as %s, got %d %q", test.header, test.value, test.subject, rec.Code, subject)
+		}
+	}
+}
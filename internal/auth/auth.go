@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
 )
 
 // SESSIONNAME is the gorilla/sessions name
@@ -16,14 +17,103 @@ type (
 		LoginHandler(w http.ResponseWriter, r *http.Request)
 		CallbackHandler(w http.ResponseWriter, r *http.Request)
 		Middleware(next http.Handler) http.Handler
+		Health() error
+	}
+
+	// Provider identifies the user of a request
+	Provider interface {
+		// Identify returns the ACL of the user of the request or an error if the
+		// user can not be identified
+		Identify(r *http.Request) (core.ACL, error)
+	}
+
+	// LoginProvider is a Provider that supports an interactive login
+	LoginProvider interface {
+		Provider
+		LoginHandler(w http.ResponseWriter, r *http.Request)
+		CallbackHandler(w http.ResponseWriter, r *http.Request)
+		// LoginURL returns the URL users are redirected to for the login
+		LoginURL() string
+	}
+
+	// HealthProvider is a Provider that depends on external services
+	HealthProvider interface {
+		Provider
+		// Health returns an error if the provider is degraded, errors that wrap
+		// ErrUnavailable if no request can be authenticated
+		Health() error
+	}
+
+	// ChallengeProvider is a Provider that asks clients for credentials
+	ChallengeProvider interface {
+		Provider
+		// Challenge returns the WWW-Authenticate challenge of the provider
+		Challenge() string
 	}
 )
 
-// NewAuth create a new instance of the configured AuthProvider
+// NewAuth create a new Chain of the configured AuthProviders
 func NewAuth(cfg *config.Config, authPath string) (a Auth, err error) {
-	switch cfg.AuthProvider {
+	if len(cfg.AuthProviders) == 0 {
+		return nil, fmt.Errorf("unable to find auth provider: AUTH_PROVIDER is empty")
+	}
+	providers := []NamedProvider{}
+	for _, name := range cfg.AuthProviders {
+		provider, err := newProvider(cfg, name, authPath)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, NamedProvider{Name: name, Provider: provider})
+	}
+	return NewChain(providers), nil
+}
+
+// newProvider creates a new instance of the Provider name
+func newProvider(cfg *config.Config, name string, authPath string) (Provider, error) {
+	switch name {
 	case "oidc":
 		return NewOauthAuth(cfg, authPath)
+	case "apikey":
+		return NewKeyAuth(cfg)
+	case "mtls":
+		return NewCertAuth(cfg)
+	case "header":
+		return NewHeaderAuth(cfg)
+	case "htpasswd":
+		return NewHtpasswdAuth(cfg)
+	case "jwt":
+		return NewJWTAuth(cfg)
+	case "introspect":
+		return NewIntrospectionAuth(cfg)
+	}
+	return nil, fmt.Errorf("unable to find auth provider %s", name)
+}
+
+// aclForRoles returns the ACL of the first role that has an ACL bound to claims, the
+// deny ACL if no role has an ACL
+func aclForRoles(cfg *config.Config, roles []string, claims map[string]interface{}) core.ACL {
+	for _, role := range roles {
+		roleACL, ok := cfg.ACLMap.GetACL(role)
+		if ok {
+			return roleACL.WithClaims(claims)
+		}
+	}
+	return cfg.ACLMap.GetDenyACL()
+}
+
+// claimRoles loads the role names from the list in claim
+func claimRoles(claims map[string]interface{}, claim string) ([]string, error) {
+	roles, ok := claims[claim].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unable to load acces token claims from %s", claim)
+	}
+	roleNames := []string{}
+	for _, role := range roles {
+		role, ok := role.(string)
+		if !ok {
+			continue
+		}
+		roleNames = append(roleNames, role)
 	}
-	return nil, fmt.Errorf("unable to find auth provider")
+	return roleNames, nil
 }
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitsbeats/prometheus-acls/internal/prom"
+)
+
+type (
+	// Chain identifies requests with the first matching Provider
+	Chain struct {
+		providers []NamedProvider
+		login     LoginProvider
+	}
+
+	// NamedProvider is a Provider of a Chain
+	NamedProvider struct {
+		Name     string
+		Provider Provider
+	}
+)
+
+// NewChain creates a new Chain that tries the providers in order. The first
+// LoginProvider handles the interactive login
+func NewChain(providers []NamedProvider) (c *Chain) {
+	c = &Chain{providers: providers}
+	for _, provider := range providers {
+		if login, ok := provider.Provider.(LoginProvider); ok {
+			c.login = login
+			break
+		}
+	}
+	return
+}
+
+// LoginHandler is the HTTP route for the login
+func (c *Chain) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if c.login == nil {
+		http.Error(w, "login is not supported", http.StatusNotFound)
+		return
+	}
+	c.login.LoginHandler(w, r)
+}
+
+// CallbackHandler is the HTTP route for callback
+func (c *Chain) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if c.login == nil {
+		http.Error(w, "login is not supported", http.StatusNotFound)
+		return
+	}
+	c.login.CallbackHandler(w, r)
+}
+
+// Health reports the errors of all providers that are degraded. The chain is only
+// unavailable if no provider is able to authenticate requests
+func (c *Chain) Health() error {
+	errs := []string{}
+	unavailable := 0
+	for _, provider := range c.providers {
+		health, ok := provider.Provider.(HealthProvider)
+		if !ok {
+			continue
+		}
+		err := health.Health()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", provider.Name, err))
+			if errors.Is(err, ErrUnavailable) {
+				unavailable++
+			}
+		}
+	}
+	switch {
+	case unavailable > 0 && unavailable == len(c.providers):
+		return fmt.Errorf("%w: %s", ErrUnavailable, strings.Join(errs, ", "))
+	case len(errs) > 0:
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Middleware identifies the user with the providers and redirects interactive clients
+// to the login if no provider identified the user
+func (c *Chain) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs := []string{}
+		for _, provider := range c.providers {
+			acl, err := provider.Provider.Identify(r)
+			if err != nil {
+				log.WithError(err).WithField("provider", provider.Name).Debug("unable to identify request")
+				errs = append(errs, fmt.Sprintf("%s: %s", provider.Name, err))
+				continue
+			}
+			r = r.WithContext(context.WithValue(r.Context(), "acl", acl))
+
+			// handle request
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.login != nil && isInteractive(r) {
+			// the requested URL is restored after the login
+			returnTo := url.Values{"return_to": {r.URL.RequestURI()}}
+			http.Redirect(w, r, c.login.LoginURL()+"?"+returnTo.Encode(), http.StatusTemporaryRedirect)
+			return
+		}
+		for _, provider := range c.providers {
+			if challenger, ok := provider.Provider.(ChallengeProvider); ok {
+				w.Header().Add("WWW-Authenticate", challenger.Challenge())
+			}
+		}
+		msg := fmt.Sprintf("unable to authenticate: %s", strings.Join(errs, ", "))
+		prom.SendError(w, r, msg, http.StatusUnauthorized, nil)
+	})
+}
+
+// isInteractive checks if the request is made by a browser that can follow a login
+func isInteractive(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	if strings.HasPrefix(r.URL.EscapedPath(), "/api/") {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+	"github.com/bitsbeats/prometheus-acls/internal/prom"
+)
+
+type aclMockNamed string
+
+func (am aclMockNamed) GetLabelMatchers(string) []*labels.Matcher {
+	return nil
+}
+
+type providerMock struct {
+	header string
+}
+
+func (p providerMock) Identify(r *http.Request) (core.ACL, error) {
+	if r.Header.Get(p.header) == "" {
+		return nil, fmt.Errorf("%s missing", p.header)
+	}
+	return aclMockNamed(p.header), nil
+}
+
+type healthProviderMock struct {
+	providerMock
+	err error
+}
+
+func (p healthProviderMock) Health() error {
+	return p.err
+}
+
+type loginProviderMock struct {
+	providerMock
+}
+
+func (p loginProviderMock) LoginHandler(w http.ResponseWriter, r *http.Request) {}
+
+func (p loginProviderMock) CallbackHandler(w http.ResponseWriter, r *http.Request) {}
+
+func (p loginProviderMock) LoginURL() string {
+	return "/oauth/login"
+}
+
+func TestChain(t *testing.T) {
+	c := NewChain([]NamedProvider{
+		{Name: "first", Provider: providerMock{header: "X-First"}},
+		{Name: "login", Provider: loginProviderMock{providerMock{header: "X-Login"}}},
+		{Name: "second", Provider: providerMock{header: "X-Second"}},
+	})
+
+	tests := []struct {
+		path    string
+		headers map[string]string
+		code    int
+		acl     string
+		prom    bool
+	}{{
+		path:    "/api/v1/query",
+		headers: map[string]string{"X-First": "1", "X-Second": "1"},
+		code:    http.StatusOK,
+		acl:     "X-First",
+	}, {
+		path:    "/api/v1/query",
+		headers: map[string]string{"X-Second": "1"},
+		code:    http.StatusOK,
+		acl:     "X-Second",
+	}, {
+		path:    "/graph",
+		headers: map[string]string{"Accept": "text/html,application/xhtml+xml"},
+		code:    http.StatusTemporaryRedirect,
+	}, {
+		path:    "/api/v1/query",
+		headers: map[string]string{"Accept": "text/html"},
+		code:    http.StatusUnauthorized,
+		prom:    true,
+	}, {
+		path:    "/api/v1/series",
+		headers: map[string]string{},
+		code:    http.StatusUnauthorized,
+		prom:    true,
+	}, {
+		path:    "/graph",
+		headers: map[string]string{"Accept": "text/html", "Authorization": "Bearer invalid"},
+		code:    http.StatusUnauthorized,
+	}, {
+		path:    "/graph",
+		headers: map[string]string{"Accept": "application/json"},
+		code:    http.StatusUnauthorized,
+	}}
+	for _, test := range tests {
+		var acl core.ACL
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acl, _ = r.Context().Value("acl").(core.ACL)
+		})
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		c.Middleware(next).ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Fatalf("invalid status for %s %v: want %d, got %d", test.path, test.headers, test.code, rec.Code)
+		}
+		if test.acl != "" && acl != aclMockNamed(test.acl) {
+			t.Fatalf("invalid acl for %s %v: want %s, got %v", test.path, test.headers, test.acl, acl)
+		}
+		// api errors use the prometheus error format
+		p := prom.Error{}
+		err := json.Unmarshal(rec.Body.Bytes(), &p)
+		if test.prom && (err != nil || p.Status != "error" || p.Error == "") {
+			t.Fatalf("expected prometheus error for %s %v, got %q", test.path, test.headers, rec.Body.String())
+		}
+		if !test.prom && err == nil && p.Status == "error" {
+			t.Fatalf("unexpected prometheus error for %s %v", test.path, test.headers)
+		}
+	}
+}
+
+func TestChainHealth(t *testing.T) {
+	unavailable := fmt.Errorf("%w: idp down", ErrUnavailable)
+	tests := []struct {
+		name        string
+		providers   []NamedProvider
+		degraded    bool
+		unavailable bool
+	}{{
+		name: "healthy",
+		providers: []NamedProvider{
+			{Name: "apikey", Provider: providerMock{header: "X-Api-Key"}},
+			{Name: "oidc", Provider: healthProviderMock{err: nil}},
+		},
+	}, {
+		name: "one provider unavailable",
+		providers: []NamedProvider{
+			{Name: "apikey", Provider: providerMock{header: "X-Api-Key"}},
+			{Name: "oidc", Provider: healthProviderMock{err: unavailable}},
+		},
+		degraded: true,
+	}, {
+		name: "one provider degraded",
+		providers: []NamedProvider{
+			{Name: "oidc", Provider: healthProviderMock{err: fmt.Errorf("refresh failed")}},
+		},
+		degraded: true,
+	}, {
+		name: "all providers unavailable",
+		providers: []NamedProvider{
+			{Name: "oidc", Provider: healthProviderMock{err: unavailable}},
+			{Name: "mtls", Provider: healthProviderMock{err: unavailable}},
+		},
+		degraded:    true,
+		unavailable: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := NewChain(test.providers).Health()
+			if (err != nil) != test.degraded {
+				t.Errorf("expected degraded %t, got %v", test.degraded, err)
+			}
+			if errors.Is(err, ErrUnavailable) != test.unavailable {
+				t.Errorf("expected unavailable %t, got %v", test.unavailable, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// ErrUnavailable is returned by the Health of providers that are unable to
+// authenticate any request
+var ErrUnavailable = errors.New("auth unavailable")
+
+var (
+	// discoveryBackoff is the initial delay between failed discoveries, it is doubled
+	// up to discoveryMaxBackoff
+	discoveryBackoff    = time.Second
+	discoveryMaxBackoff = 5 * time.Minute
+
+	// jwksRefreshInterval is the interval the keys of the provider are refreshed
+	jwksRefreshInterval = 15 * time.Minute
+	// jwksMinRefreshInterval limits the refreshes for tokens with unknown keys
+	jwksMinRefreshInterval = 30 * time.Second
+)
+
+type (
+	// oidcDiscovery discovers the oidc provider in the background and keeps the last
+	// known good keys of the provider. It implements oidc.KeySet
+	oidcDiscovery struct {
+		issuer    string
+		cacheFile string
+		client    *http.Client
+
+		mutex       sync.Mutex
+		endpoint    *oauth2.Endpoint
+		jwksURL     string
+		keys        *staticKeySet
+		lastRefresh time.Time
+		err         error
+	}
+)
+
+// newOidcDiscovery creates a new oidcDiscovery for issuer. The keys are loaded from
+// the optional cacheFile until the provider is reachable
+func newOidcDiscovery(issuer string, cacheFile string) (d *oidcDiscovery) {
+	d = &oidcDiscovery{
+		issuer:    issuer,
+		cacheFile: cacheFile,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		err:       fmt.Errorf("discovery pending"),
+	}
+	if _, err := os.Stat(cacheFile); cacheFile != "" && err == nil {
+		keys, err := loadKeySet(cacheFile)
+		if err != nil {
+			log.WithError(err).Warn("unable to load cached oidc keys")
+		} else {
+			log.WithField("file", cacheFile).Info("loaded cached oidc keys")
+			d.keys = keys
+		}
+	}
+	go d.run()
+	return
+}
+
+// run discovers the provider with exponential backoff and refreshes the keys afterwards
+func (d *oidcDiscovery) run() {
+	backoff := discoveryBackoff
+	for {
+		err := d.discover()
+		if err == nil {
+			break
+		}
+		log.WithError(err).WithField("retry", backoff).Warn("unable to discover oidc provider")
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > discoveryMaxBackoff {
+			backoff = discoveryMaxBackoff
+		}
+	}
+	log.WithField("issuer", d.issuer).Info("discovered oidc provider")
+
+	tick := time.NewTicker(jwksRefreshInterval)
+	for range tick.C {
+		err := d.refresh()
+		if err != nil {
+			log.WithError(err).Warn("unable to refresh oidc keys, using last known keys")
+		}
+	}
+}
+
+// discover loads the endpoints and the keys of the provider
+func (d *oidcDiscovery) discover() error {
+	ctx, cancel := context.WithTimeout(oidc.ClientContext(context.Background(), d.client), d.client.Timeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, d.issuer)
+	if err != nil {
+		d.setErr(err)
+		return err
+	}
+	var claims struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	err = provider.Claims(&claims)
+	if err != nil || claims.JWKSURL == "" {
+		err = fmt.Errorf("unable to load jwks_uri of provider: %v", err)
+		d.setErr(err)
+		return err
+	}
+	endpoint := provider.Endpoint()
+	d.mutex.Lock()
+	d.endpoint = &endpoint
+	d.jwksURL = claims.JWKSURL
+	d.mutex.Unlock()
+	return d.refresh()
+}
+
+// refresh fetches the keys of the provider and stores them in the cacheFile
+func (d *oidcDiscovery) refresh() error {
+	d.mutex.Lock()
+	jwksURL := d.jwksURL
+	d.lastRefresh = time.Now()
+	d.mutex.Unlock()
+
+	keys, raw, err := d.fetchKeys(jwksURL)
+	if err != nil {
+		d.setErr(err)
+		return err
+	}
+	d.mutex.Lock()
+	d.keys = keys
+	d.err = nil
+	d.mutex.Unlock()
+
+	if d.cacheFile != "" {
+		err = writeFileAtomic(d.cacheFile, raw)
+		if err != nil {
+			log.WithError(err).Warn("unable to cache oidc keys")
+		}
+	}
+	return nil
+}
+
+// fetchKeys loads the keys from jwksURL
+func (d *oidcDiscovery) fetchKeys(jwksURL string) (*staticKeySet, []byte, error) {
+	resp, err := d.client.Get(jwksURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to fetch oidc keys: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unable to fetch oidc keys: unexpected status %s", resp.Status)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to fetch oidc keys: %s", err)
+	}
+	keys, err := parseKeySet(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse oidc keys: %s", err)
+	}
+	return keys, raw, nil
+}
+
+// setErr stores the last error of the discovery
+func (d *oidcDiscovery) setErr(err error) {
+	d.mutex.Lock()
+	d.err = err
+	d.mutex.Unlock()
+}
+
+// VerifySignature verifies the jwt with the last known keys. The keys are refreshed
+// if no key verifies the jwt, e.g. after a key rotation
+func (d *oidcDiscovery) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	d.mutex.Lock()
+	keys := d.keys
+	refresh := d.jwksURL != "" && time.Since(d.lastRefresh) > jwksMinRefreshInterval
+	d.mutex.Unlock()
+
+	err := fmt.Errorf("no oidc keys available")
+	if keys != nil {
+		var payload []byte
+		payload, err = keys.VerifySignature(ctx, jwt)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	if !refresh || d.refresh() != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	keys = d.keys
+	d.mutex.Unlock()
+	return keys.VerifySignature(ctx, jwt)
+}
+
+// Endpoint returns the oauth2 endpoint of the provider once it is discovered
+func (d *oidcDiscovery) Endpoint() (oauth2.Endpoint, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.endpoint == nil {
+		return oauth2.Endpoint{}, fmt.Errorf("oidc provider not discovered yet: %s", d.err)
+	}
+	return *d.endpoint, nil
+}
+
+// Health reports errors of the discovery. ErrUnavailable is returned if no keys
+// are available to verify tokens
+func (d *oidcDiscovery) Health() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.keys == nil {
+		return fmt.Errorf("%w: %s", ErrUnavailable, d.err)
+	}
+	return d.err
+}
+
+// writeFileAtomic replaces file with data, readers never see a partial file
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp.Name(), file)
+}
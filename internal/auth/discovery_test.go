@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestOidcDiscovery(t *testing.T) {
+	discoveryBackoff = 10 * time.Millisecond
+	discoveryMaxBackoff = 10 * time.Millisecond
+	jwksMinRefreshInterval = 0
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey := atomic.Value{}
+	signingKey.Store(jose.JSONWebKey{Key: &key.PublicKey, KeyID: "1", Algorithm: "RS256"})
+
+	up := atomic.Bool{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "%[1]s/auth", "token_endpoint": "%[1]s/token", "jwks_uri": "%[1]s/jwks"}`, server.URL)
+		case "/jwks":
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{signingKey.Load().(jose.JSONWebKey)}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	sign := func(key *rsa.PrivateKey, kid string) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign([]byte(`{"sub": "alice"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _ := jws.CompactSerialize()
+		return token
+	}
+	waitFor := func(d *oidcDiscovery, healthy func(error) bool) {
+		for i := 0; i < 200 && !healthy(d.Health()); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := d.Health(); !healthy(err) {
+			t.Fatalf("unexpected health %v", err)
+		}
+	}
+
+	// the provider is unreachable and no keys are cached
+	cacheFile := filepath.Join(t.TempDir(), "jwks.json")
+	d := newOidcDiscovery(server.URL, cacheFile)
+	if err := d.Health(); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("expected unavailable, got %v", err)
+	}
+	_, err = d.VerifySignature(context.Background(), sign(key, "1"))
+	if err == nil {
+		t.Fatal("expected error without keys")
+	}
+	if _, err := d.Endpoint(); err == nil {
+		t.Fatal("expected error before discovery")
+	}
+
+	// the discovery is retried until the provider is reachable
+	up.Store(true)
+	waitFor(d, func(err error) bool { return err == nil })
+	_, err = d.VerifySignature(context.Background(), sign(key, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := d.Endpoint()
+	if err != nil || endpoint.TokenURL != server.URL+"/token" {
+		t.Fatalf("unexpected endpoint %+v: %v", endpoint, err)
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Fatalf("expected cached keys: %s", err)
+	}
+
+	// unknown keys trigger a refresh
+	signingKey.Store(jose.JSONWebKey{Key: &rotatedKey.PublicKey, KeyID: "2", Algorithm: "RS256"})
+	_, err = d.VerifySignature(context.Background(), sign(rotatedKey, "2"))
+	if err != nil {
+		t.Fatalf("expected rotated key to be loaded: %s", err)
+	}
+
+	// the cached keys are used while the provider is unreachable
+	up.Store(false)
+	cached := newOidcDiscovery(server.URL, cacheFile)
+	waitFor(cached, func(err error) bool { return err != nil && !errors.Is(err, ErrUnavailable) })
+	_, err = cached.VerifySignature(context.Background(), sign(rotatedKey, "2"))
+	if err != nil {
+		t.Fatalf("expected cached key to verify: %s", err)
+	}
+	_, err = cached.VerifySignature(context.Background(), sign(key, "1"))
+	if err == nil {
+		t.Fatal("expected rotated out key to fail")
+	}
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type (
+	// HeaderAuth trusts the identity headers set by an authenticating reverse proxy
+	// like oauth2-proxy
+	HeaderAuth struct {
+		cfg *config.Config
+	}
+)
+
+// NewHeaderAuth creates a new HeaderAuth, the headers are only trusted for requests
+// from TRUSTED_PROXIES or with the TRUSTED_SECRET
+func NewHeaderAuth(cfg *config.Config) (a *HeaderAuth, err error) {
+	if len(cfg.TrustedNetworks) == 0 && cfg.TrustedSecret == "" {
+		return nil, fmt.Errorf("unable to setup header auth: TRUSTED_PROXIES or TRUSTED_SECRET is required")
+	}
+	if cfg.TrustedUserHeader == "" {
+		return nil, fmt.Errorf("unable to setup header auth: TRUSTED_USER_HEADER is empty")
+	}
+	return &HeaderAuth{cfg: cfg}, nil
+}
+
+// trusted checks if the request was sent by a trusted proxy
+func (a *HeaderAuth) trusted(r *http.Request) bool {
+	if a.cfg.TrustedSecret != "" {
+		secret := r.Header.Get(a.cfg.TrustedSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(a.cfg.TrustedSecret)) == 1 {
+			return true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.cfg.TrustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// roles maps the groups of the request to roles, groups without mapping are ignored
+// unless TRUSTED_GROUPS_AS_ROLES is set
+func (a *HeaderAuth) roles(r *http.Request) (roles []string) {
+	for _, header := range r.Header.Values(a.cfg.TrustedGroupsHeader) {
+		for _, group := range strings.Split(header, ",") {
+			group = strings.TrimSpace(group)
+			if group == "" {
+				continue
+			}
+			if role, ok := a.cfg.TrustedGroupRoles[group]; ok {
+				roles = append(roles, role)
+			} else if a.cfg.TrustedGroupsAsRoles {
+				roles = append(roles, group)
+			}
+		}
+	}
+	return
+}
+
+// Identify loads the user and groups from the headers of a trusted proxy
+func (a *HeaderAuth) Identify(r *http.Request) (core.ACL, error) {
+	user := r.Header.Get(a.cfg.TrustedUserHeader)
+	if user == "" {
+		return nil, fmt.Errorf("no %s header in request", a.cfg.TrustedUserHeader)
+	}
+	if !a.trusted(r) {
+		return nil, fmt.Errorf("untrusted %s header from %s", a.cfg.TrustedUserHeader, r.RemoteAddr)
+	}
+	// the shared secret is not forwarded
+	r.Header.Del(a.cfg.TrustedSecretHeader)
+	claims := map[string]interface{}{
+		"sub": user,
+	}
+	return aclForRoles(a.cfg, a.roles(r), claims), nil
+}
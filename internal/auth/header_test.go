@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+func TestHeaderAuth(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg := &config.Config{
+		TrustedUserHeader:   "X-Forwarded-User",
+		TrustedGroupsHeader: "X-Forwarded-Groups",
+		TrustedSecretHeader: "X-Proxy-Secret",
+		TrustedSecret:       "secret",
+		TrustedNetworks:     []*net.IPNet{network},
+		TrustedGroupRoles:   map[string]string{"team-dev": "developer", "team-ops": "admin"},
+		ACLMap: config.ACLMap{
+			"developer": &config.ACL{Role: "developer"},
+			"admin":     &config.ACL{Role: "admin"},
+		},
+	}
+	a, err := NewHeaderAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		role       string
+	}{{
+		name:       "trusted network",
+		remoteAddr: "10.1.2.3:1234",
+		headers:    map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": "unknown, team-dev"},
+		role:       "developer",
+	}, {
+		name:       "shared secret",
+		remoteAddr: "192.0.2.1:1234",
+		headers:    map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": "team-ops", "X-Proxy-Secret": "secret"},
+		role:       "admin",
+	}, {
+		name:       "unmapped group named like a role",
+		remoteAddr: "10.1.2.3:1234",
+		headers:    map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": "admin"},
+		role:       "deny",
+	}, {
+		name:       "no matching group",
+		remoteAddr: "10.1.2.3:1234",
+		headers:    map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": "unknown"},
+		role:       "deny",
+	}, {
+		name:       "untrusted network",
+		remoteAddr: "192.0.2.1:1234",
+		headers:    map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": "admin"},
+	}, {
+		name:       "wrong secret",
+		remoteAddr: "192.0.2.1:1234",
+		headers:    map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Groups": "admin", "X-Proxy-Secret": "wrong"},
+	}, {
+		name:       "no user",
+		remoteAddr: "10.1.2.3:1234",
+		headers:    map[string]string{"X-Forwarded-Groups": "admin"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			r.RemoteAddr = test.remoteAddr
+			for header, value := range test.headers {
+				r.Header.Set(header, value)
+			}
+			acl, err := a.Identify(r)
+			if test.role == "" {
+				if err == nil {
+					t.Fatalf("expected error, got acl %+v", acl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.role == "deny" {
+				if deny, ok := acl.(*config.ACL); !ok || deny.Role != "" {
+					t.Errorf("expected deny acl, got %+v", acl)
+				}
+				return
+			}
+			identity := acl.(core.IdentityACL)
+			if identity.GetRole() != test.role || identity.GetSubject() != "alice" {
+				t.Errorf("expected %s/alice, got %s/%s", test.role, identity.GetRole(), identity.GetSubject())
+			}
+			if r.Header.Get("X-Proxy-Secret") != "" {
+				t.Error("expected shared secret to be removed")
+			}
+		})
+	}
+
+	// unmapped groups are used as role on opt-in
+	cfg.TrustedGroupsAsRoles = true
+	r := httptest.NewRequest("GET", "/api/v1/query", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.Header.Set("X-Forwarded-Groups", "admin")
+	acl, err := a.Identify(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, ok := acl.(core.IdentityACL); !ok || identity.GetRole() != "admin" {
+		t.Errorf("expected admin, got %+v", acl)
+	}
+}
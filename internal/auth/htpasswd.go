@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type (
+	// HtpasswdAuth authenticates users with basic auth against a htpasswd file, the
+	// users and their roles are re-read when the files change
+	HtpasswdAuth struct {
+		cfg *config.Config
+
+		mutex        sync.Mutex
+		users        map[string]*htpasswdUser
+		usersModTime time.Time
+		roles        map[string][]string
+		rolesModTime time.Time
+	}
+
+	// htpasswdUser is a user of the htpasswd file that remembers its last verified
+	// password
+	htpasswdUser struct {
+		hash []byte
+
+		mutex    sync.Mutex
+		verified []byte
+	}
+)
+
+// NewHtpasswdAuth creates a new HtpasswdAuth for the HTPASSWD_FILE of cfg
+func NewHtpasswdAuth(cfg *config.Config) (a *HtpasswdAuth, err error) {
+	if cfg.HtpasswdFile == "" || cfg.HtpasswdRolesFile == "" {
+		return nil, fmt.Errorf("unable to setup htpasswd auth: HTPASSWD_FILE and HTPASSWD_ROLES_FILE are required")
+	}
+	a = &HtpasswdAuth{cfg: cfg}
+	err = a.load()
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup htpasswd auth: %s", err)
+	}
+	return
+}
+
+// Challenge returns the basic auth challenge
+func (a *HtpasswdAuth) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", a.cfg.HtpasswdRealm)
+}
+
+// load reads the htpasswd and roles files if they have been modified
+func (a *HtpasswdAuth) load() error {
+	usersInfo, err := os.Stat(a.cfg.HtpasswdFile)
+	if err != nil {
+		return fmt.Errorf("unable to read htpasswd file: %s", err)
+	}
+	rolesInfo, err := os.Stat(a.cfg.HtpasswdRolesFile)
+	if err != nil {
+		return fmt.Errorf("unable to read htpasswd roles: %s", err)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !usersInfo.ModTime().Equal(a.usersModTime) {
+		users, err := parseHtpasswd(a.cfg.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+		a.users, a.usersModTime = users, usersInfo.ModTime()
+	}
+	if !rolesInfo.ModTime().Equal(a.rolesModTime) {
+		fp, err := os.Open(a.cfg.HtpasswdRolesFile)
+		if err != nil {
+			return fmt.Errorf("unable to read htpasswd roles: %s", err)
+		}
+		defer fp.Close()
+		roles := map[string][]string{}
+		decoder := yaml.NewDecoder(fp)
+		decoder.SetStrict(true)
+		err = decoder.Decode(&roles)
+		if err != nil {
+			return fmt.Errorf("unable to load htpasswd roles: %s", err)
+		}
+		a.roles, a.rolesModTime = roles, rolesInfo.ModTime()
+	}
+	return nil
+}
+
+// parseHtpasswd reads the bcrypt hashes of a htpasswd file, other hashes are skipped
+func parseHtpasswd(file string) (users map[string]*htpasswdUser, err error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read htpasswd file: %s", err)
+	}
+	defer fp.Close()
+	users = map[string]*htpasswdUser{}
+	scanner := bufio.NewScanner(fp)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unable to load htpasswd file: invalid line %d", line)
+		}
+		if !strings.HasPrefix(parts[1], "$2") {
+			log.WithField("user", parts[0]).Warn("skipping htpasswd user without bcrypt hash")
+			continue
+		}
+		users[parts[0]] = &htpasswdUser{hash: []byte(parts[1])}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read htpasswd file: %s", err)
+	}
+	return
+}
+
+// verify checks the password against the hash of the user. The digest of the last
+// valid password is kept, so the expensive hash is only computed once
+func (u *htpasswdUser) verify(password string) bool {
+	digest := sha256.Sum256([]byte(password))
+	u.mutex.Lock()
+	verified := u.verified
+	u.mutex.Unlock()
+	if verified != nil && subtle.ConstantTimeCompare(verified, digest[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+		return false
+	}
+	u.mutex.Lock()
+	u.verified = digest[:]
+	u.mutex.Unlock()
+	return true
+}
+
+// Identify verifies the basic auth credentials of the request
+func (a *HtpasswdAuth) Identify(r *http.Request) (core.ACL, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, fmt.Errorf("no basic auth in request")
+	}
+	err := a.load()
+	if err != nil {
+		// the last valid files are used until the error is fixed
+		log.WithError(err).Warn("unable to reload htpasswd auth")
+	}
+
+	a.mutex.Lock()
+	user, ok := a.users[username]
+	roles := a.roles[username]
+	a.mutex.Unlock()
+	if !ok || !user.verify(password) {
+		return nil, fmt.Errorf("invalid credentials for user %s", username)
+	}
+	claims := map[string]interface{}{
+		"sub": username,
+	}
+	return aclForRoles(a.cfg, roles, claims), nil
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+func TestHtpasswdAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeFile := func(file string, content string, modTime time.Time) {
+		err := os.WriteFile(file, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	usersFile := filepath.Join(dir, "htpasswd")
+	rolesFile := filepath.Join(dir, "roles.yml")
+	writeFile(usersFile, "# users\nalice:"+string(hash)+"\nbob:{SHA}invalid\n", time.Now())
+	writeFile(rolesFile, "alice: [unknown, developer]\n", time.Now())
+
+	cfg := &config.Config{
+		HtpasswdFile:      usersFile,
+		HtpasswdRolesFile: rolesFile,
+		HtpasswdRealm:     "prometheus-acls",
+		ACLMap:            config.ACLMap{"developer": &config.ACL{Role: "developer"}},
+	}
+	a, err := NewHtpasswdAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChain([]NamedProvider{{Name: "htpasswd", Provider: a}})
+
+	var role string
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, ok := r.Context().Value("acl").(core.IdentityACL); ok {
+			role = identity.GetRole()
+		}
+	}))
+	request := func(username string, password string) *httptest.ResponseRecorder {
+		role = ""
+		r := httptest.NewRequest("GET", "/api/v1/query", nil)
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		code     int
+	}{
+		{"valid", "alice", "secret", http.StatusOK},
+		{"cached", "alice", "secret", http.StatusOK},
+		{"wrong password", "alice", "wrong", http.StatusUnauthorized},
+		{"unsupported hash", "bob", "invalid", http.StatusUnauthorized},
+		{"no credentials", "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := request(test.username, test.password)
+			if w.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if test.code == http.StatusOK && role != "developer" {
+				t.Errorf("expected role developer, got %s", role)
+			}
+			if test.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Basic realm="prometheus-acls"` {
+				t.Errorf("unexpected challenge %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// the files are re-read when they change
+	writeFile(usersFile, "alice:"+string(hash)+"\n", time.Now().Add(time.Minute))
+	writeFile(rolesFile, "alice: [unknown]\n", time.Now().Add(time.Minute))
+	w := request("alice", "secret")
+	if w.Code != http.StatusOK || role != "" {
+		t.Errorf("expected deny acl after reload, got %d with role %q", w.Code, role)
+	}
+	writeFile(usersFile, "", time.Now().Add(2*time.Minute))
+	w = request("alice", "secret")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected removed user to be rejected, got %d", w.Code)
+	}
+}
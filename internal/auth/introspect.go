@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type (
+	// IntrospectionAuth verifies opaque access tokens with the introspection endpoint
+	// of the authorization server (RFC 7662)
+	IntrospectionAuth struct {
+		cfg    *config.Config
+		client *http.Client
+
+		// clientID and clientSecret authenticate the introspection requests
+		clientID     string
+		clientSecret string
+
+		// cache holds the introspection of active tokens by their digest
+		cache *sync.Map
+	}
+
+	// introspection is the cached response of the introspection endpoint
+	introspection struct {
+		claims  map[string]interface{}
+		expires time.Time
+	}
+)
+
+// NewIntrospectionAuth creates a new IntrospectionAuth for the INTROSPECTION_URL
+func NewIntrospectionAuth(cfg *config.Config) (a *IntrospectionAuth, err error) {
+	if cfg.IntrospectionURL == "" {
+		return nil, fmt.Errorf("unable to setup introspection: INTROSPECTION_URL is required")
+	}
+	a = &IntrospectionAuth{
+		cfg:          cfg,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		clientID:     cfg.IntrospectionClientID,
+		clientSecret: cfg.IntrospectionClientSecret,
+		cache:        &sync.Map{},
+	}
+	if a.clientID == "" {
+		// the client of the login is used by default
+		a.clientID, a.clientSecret = cfg.OidcClientID, cfg.OidcClientSecret
+	}
+	if a.clientID == "" {
+		return nil, fmt.Errorf("unable to setup introspection: INTROSPECTION_CLIENT_ID or OIDC_CLIENT_ID is required")
+	}
+
+	// cleanup of expired tokens
+	tick := time.NewTicker(10 * time.Minute)
+	go func() {
+		for now := range tick.C {
+			a.cache.Range(func(key, value interface{}) bool {
+				if value.(*introspection).expires.Before(now) {
+					a.cache.Delete(key)
+				}
+				return true
+			})
+		}
+	}()
+	return
+}
+
+// introspect loads the claims of token from the cache or the introspection endpoint.
+// Active tokens are cached until they expire
+func (a *IntrospectionAuth) introspect(r *http.Request, token string) (map[string]interface{}, error) {
+	digest := sha256.Sum256([]byte(token))
+	if cached, ok := a.cache.Load(digest); ok {
+		cached := cached.(*introspection)
+		if time.Now().Before(cached.expires) {
+			return cached.claims, nil
+		}
+		a.cache.Delete(digest)
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, a.cfg.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create introspection request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to introspect token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to introspect token: unexpected status %s", resp.Status)
+	}
+	claims := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode introspection: %s", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, fmt.Errorf("token is not active")
+	}
+
+	// tokens without expiry are introspected on every request
+	if exp, ok := claims["exp"].(float64); ok {
+		expires := time.Unix(int64(exp), 0)
+		if !time.Now().Before(expires) {
+			return nil, fmt.Errorf("token is expired")
+		}
+		a.cache.Store(digest, &introspection{claims: claims, expires: expires})
+	} else {
+		log.Debug("introspected token has no expiry, not caching")
+	}
+	return claims, nil
+}
+
+// Identify verifies the bearer token of the request with the introspection endpoint
+func (a *IntrospectionAuth) Identify(r *http.Request) (core.ACL, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, fmt.Errorf("no bearer token in request")
+	}
+	claims, err := a.introspect(r, strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	roles, err := claimRoles(claims, a.cfg.IntrospectionRolesClaim)
+	if err != nil {
+		return nil, err
+	}
+	return aclForRoles(a.cfg, roles, claims), nil
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+func TestIntrospectionAuth(t *testing.T) {
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "promacl" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := r.PostFormValue("token")
+		calls[token]++
+		response := map[string]interface{}{"active": false}
+		switch token {
+		case "valid":
+			response = map[string]interface{}{
+				"active": true,
+				"sub":    "alice",
+				"exp":    time.Now().Add(time.Hour).Unix(),
+				"roles":  []string{"developer"},
+			}
+		case "noexp":
+			response = map[string]interface{}{
+				"active": true,
+				"sub":    "bob",
+				"roles":  []string{"developer"},
+			}
+		case "expired":
+			response = map[string]interface{}{
+				"active": true,
+				"sub":    "alice",
+				"exp":    time.Now().Add(-time.Hour).Unix(),
+				"roles":  []string{"developer"},
+			}
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		IntrospectionURL:        server.URL,
+		OidcClientID:            "promacl",
+		OidcClientSecret:        "secret",
+		IntrospectionRolesClaim: "roles",
+		ACLMap:                  config.ACLMap{"developer": &config.ACL{Role: "developer"}},
+	}
+	a, err := NewIntrospectionAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token   string
+		subject string
+		calls   int
+	}{
+		{"valid", "alice", 1},
+		{"valid", "alice", 1},
+		{"noexp", "bob", 1},
+		{"noexp", "bob", 2},
+		{"expired", "", 1},
+		{"inactive", "", 1},
+		{"inactive", "", 2},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/query", nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		acl, err := a.Identify(r)
+		if test.subject == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got acl %+v", test.token, acl)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.token, err)
+		} else if subject := acl.(core.IdentityACL).GetSubject(); subject != test.subject {
+			t.Errorf("%s: expected subject %s, got %s", test.token, test.subject, subject)
+		}
+		if calls[test.token] != test.calls {
+			t.Errorf("%s: expected %d introspections, got %d", test.token, test.calls, calls[test.token])
+		}
+	}
+
+	// the shared config is not modified by the defaults
+	if cfg.IntrospectionClientID != "" || cfg.IntrospectionClientSecret != "" {
+		t.Errorf("expected config to be unchanged, got client %q", cfg.IntrospectionClientID)
+	}
+
+	// invalid client credentials
+	cfg.IntrospectionClientID = "promacl"
+	cfg.IntrospectionClientSecret = "wrong"
+	a, err = NewIntrospectionAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/api/v1/query", nil)
+	r.Header.Set("Authorization", "Bearer other")
+	_, err = a.Identify(r)
+	if err == nil {
+		t.Error("expected error with invalid client credentials")
+	}
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type (
+	// JWTAuth verifies bearer JWTs offline against static keys, no discovery of the
+	// issuer is required
+	JWTAuth struct {
+		cfg      *config.Config
+		verifier *oidc.IDTokenVerifier
+	}
+
+	// staticKeySet is a oidc.KeySet of keys loaded from a file
+	staticKeySet struct {
+		keys jose.JSONWebKeySet
+	}
+)
+
+// NewJWTAuth creates a new JWTAuth for the keys in JWT_KEYS_FILE
+func NewJWTAuth(cfg *config.Config) (a *JWTAuth, err error) {
+	if cfg.JWTKeysFile == "" || cfg.JWTIssuer == "" || len(cfg.JWTAudiences) == 0 {
+		return nil, fmt.Errorf("unable to setup jwt auth: JWT_KEYS_FILE, JWT_ISSUER and JWT_AUDIENCES are required")
+	}
+	keySet, err := loadKeySet(cfg.JWTKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup jwt auth: %s", err)
+	}
+	a = &JWTAuth{cfg: cfg}
+	a.verifier = oidc.NewVerifier(cfg.JWTIssuer, keySet, &oidc.Config{
+		// the audiences and the validity are checked by auth
+		SkipClientIDCheck:    true,
+		SkipExpiryCheck:      true,
+		SupportedSigningAlgs: cfg.JWTAlgorithms,
+	})
+	return
+}
+
+// loadKeySet reads a JWKS or PEM encoded public keys and certificates from file
+func loadKeySet(file string) (*staticKeySet, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read keys: %s", err)
+	}
+	keySet, err := parseKeySet(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s in %s", err, file)
+	}
+	return keySet, nil
+}
+
+// parseKeySet parses a JWKS or PEM encoded public keys and certificates
+func parseKeySet(raw []byte) (keySet *staticKeySet, err error) {
+	keySet = &staticKeySet{}
+	if strings.HasPrefix(strings.TrimSpace(string(raw)), "{") {
+		err = json.Unmarshal(raw, &keySet.keys)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse jwks: %s", err)
+		}
+	} else {
+		for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+			var key interface{}
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err = x509.ParsePKIXPublicKey(block.Bytes)
+			case "RSA PUBLIC KEY":
+				key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+			case "CERTIFICATE":
+				var cert *x509.Certificate
+				cert, err = x509.ParseCertificate(block.Bytes)
+				if err == nil {
+					key = cert.PublicKey
+				}
+			default:
+				err = fmt.Errorf("unsupported pem block %s", block.Type)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse pem key: %s", err)
+			}
+			keySet.keys.Keys = append(keySet.keys.Keys, jose.JSONWebKey{Key: key})
+		}
+	}
+	if len(keySet.keys.Keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	for _, key := range keySet.keys.Keys {
+		if !key.Valid() || !key.IsPublic() {
+			return nil, fmt.Errorf("invalid public key %s", key.KeyID)
+		}
+	}
+	return keySet, nil
+}
+
+// VerifySignature verifies the jwt with the key of its key id, keys without key id
+// are tried for all jwts
+func (s *staticKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse jwt: %s", err)
+	}
+	kid := jws.Signatures[0].Header.KeyID
+	for _, key := range s.keys.Keys {
+		if kid != "" && key.KeyID != "" && key.KeyID != kid {
+			continue
+		}
+		payload, err := jws.Verify(&key)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("no key verifies the jwt signature")
+}
+
+// Identify verifies the bearer JWT of the request
+func (a *JWTAuth) Identify(r *http.Request) (core.ACL, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, fmt.Errorf("no bearer token in request")
+	}
+	token, err := a.verifier.Verify(r.Context(), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify jwt: %s", err)
+	}
+	if !containsAny(token.Audience, a.cfg.JWTAudiences) {
+		return nil, fmt.Errorf("unable to verify jwt: audience %q is not trusted", token.Audience)
+	}
+
+	claims := map[string]interface{}{}
+	err = token.Claims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load jwt claims: %s", err)
+	}
+	err = checkValidity(token, claims, time.Now(), a.cfg.JWTClockSkew)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify jwt: %s", err)
+	}
+	roles, err := claimRoles(claims, a.cfg.JWTRolesClaim)
+	if err != nil {
+		return nil, err
+	}
+	return aclForRoles(a.cfg, roles, claims), nil
+}
+
+// checkValidity checks the exp, nbf and iat claims of a jwt at now, the clocks of the
+// issuer may differ by skew in both directions
+func checkValidity(token *oidc.IDToken, claims map[string]interface{}, now time.Time, skew time.Duration) error {
+	if token.Expiry.IsZero() {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.Add(-skew).After(token.Expiry) {
+		return fmt.Errorf("token is expired (expiry: %s)", token.Expiry)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(skew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet (not before: %s)", time.Unix(int64(nbf), 0))
+	}
+	if now.Add(skew).Before(token.IssuedAt) {
+		return fmt.Errorf("token is issued in the future (issued at: %s)", token.IssuedAt)
+	}
+	return nil
+}
+
+// containsAny checks if one of values is in list
+func containsAny(list []string, values []string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
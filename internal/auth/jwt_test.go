@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwks, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &rsaKey.PublicKey, KeyID: "rsa", Algorithm: "RS256", Use: "sig"},
+		{Key: &ecKey.PublicKey, KeyID: "ec", Algorithm: "ES256", Use: "sig"},
+	}})
+	err = os.WriteFile(jwksFile, jwks, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := filepath.Join(dir, "keys.pem")
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	err = os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(alg jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+		opts := &jose.SignerOptions{}
+		if kid != "" {
+			opts.WithHeader("kid", kid)
+		}
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, _ := json.Marshal(claims)
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	claims := func(aud string, exp time.Duration) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   "https://issuer.example.com",
+			"sub":   "alice",
+			"aud":   aud,
+			"exp":   time.Now().Add(exp).Unix(),
+			"roles": []string{"unknown", "developer"},
+		}
+	}
+
+	withClaim := func(claims map[string]interface{}, claim string, offset time.Duration) map[string]interface{} {
+		claims[claim] = time.Now().Add(offset).Unix()
+		return claims
+	}
+
+	for _, file := range []string{jwksFile, pemFile} {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			cfg := &config.Config{
+				JWTKeysFile:   file,
+				JWTIssuer:     "https://issuer.example.com",
+				JWTAudiences:  []string{"grafana", "cli"},
+				JWTAlgorithms: []string{"RS256", "ES256"},
+				JWTClockSkew:  time.Minute,
+				JWTRolesClaim: "roles",
+				ACLMap:        config.ACLMap{"developer": &config.ACL{Role: "developer"}},
+			}
+			a, err := NewJWTAuth(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name  string
+				token string
+				valid bool
+			}{
+				{"rsa", sign(jose.RS256, rsaKey, "rsa", claims("cli", time.Hour)), true},
+				{"without kid", sign(jose.RS256, rsaKey, "", claims("grafana", time.Hour)), true},
+				{"clock skew", sign(jose.RS256, rsaKey, "", claims("grafana", -30*time.Second)), true},
+				{"expired", sign(jose.RS256, rsaKey, "", claims("grafana", -2*time.Minute)), false},
+				{"not before within skew", sign(jose.RS256, rsaKey, "", withClaim(claims("cli", time.Hour), "nbf", 30*time.Second)), true},
+				{"not before", sign(jose.RS256, rsaKey, "", withClaim(claims("cli", time.Hour), "nbf", 2*time.Minute)), false},
+				{"issued within skew", sign(jose.RS256, rsaKey, "", withClaim(claims("cli", time.Hour), "iat", 30*time.Second)), true},
+				{"issued in the future", sign(jose.RS256, rsaKey, "", withClaim(claims("cli", time.Hour), "iat", 2*time.Minute)), false},
+				{"untrusted audience", sign(jose.RS256, rsaKey, "", claims("other", time.Hour)), false},
+				{"unknown key", sign(jose.RS256, otherKey, "", claims("cli", time.Hour)), false},
+				{"unsupported algorithm", sign(jose.PS256, rsaKey, "", claims("cli", time.Hour)), false},
+				{"ec", sign(jose.ES256, ecKey, "ec", claims("cli", time.Hour)), file == jwksFile},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					r := httptest.NewRequest("GET", "/api/v1/query", nil)
+					r.Header.Set("Authorization", "Bearer "+test.token)
+					acl, err := a.Identify(r)
+					if !test.valid {
+						if err == nil {
+							t.Fatalf("expected error, got acl %+v", acl)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					identity := acl.(core.IdentityACL)
+					if identity.GetRole() != "developer" || identity.GetSubject() != "alice" {
+						t.Errorf("expected developer/alice, got %s/%s", identity.GetRole(), identity.GetSubject())
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type (
+	// CertAuth authenticates clients with verified TLS client certificates
+	CertAuth struct {
+		cfg *config.Config
+		crl *revocationList
+	}
+
+	// revocationList holds the revoked serials of a CRL file signed by one of the
+	// issuers, the file is re-read when it changes
+	revocationList struct {
+		path    string
+		issuers []*x509.Certificate
+
+		mutex      sync.Mutex
+		modTime    time.Time
+		nextUpdate time.Time
+		revoked    map[string]bool
+	}
+)
+
+// NewServerTLSConfig creates the tls.Config of the listener. Client certificates are
+// verified against the TLS_CLIENT_CA_FILE if the client sends one
+func NewServerTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	ca, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client ca: %s", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("unable to read client ca: no certificates found in %s", cfg.TLSClientCAFile)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// NewCertAuth creates a new CertAuth for the client certificate rules of cfg
+func NewCertAuth(cfg *config.Config) (a *CertAuth, err error) {
+	if cfg.TLSCertFile == "" || cfg.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("unable to setup mtls auth: TLS_CERT_FILE, TLS_KEY_FILE and TLS_CLIENT_CA_FILE are required")
+	}
+	if len(cfg.CertRules) == 0 {
+		return nil, fmt.Errorf("unable to setup mtls auth: no rules configured in TLS_CLIENT_RULES_FILE")
+	}
+	a = &CertAuth{cfg: cfg}
+	if cfg.TLSCRLFile != "" {
+		var issuers []*x509.Certificate
+		issuers, err = loadCertificates(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup mtls auth: %s", err)
+		}
+		a.crl = &revocationList{path: cfg.TLSCRLFile, issuers: issuers}
+		err = a.crl.load()
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup mtls auth: %s", err)
+		}
+	}
+	return
+}
+
+// loadCertificates reads the PEM encoded certificates of file
+func loadCertificates(file string) (certs []*x509.Certificate, err error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client ca: %s", err)
+	}
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client ca: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("unable to read client ca: no certificates found in %s", file)
+	}
+	return certs, nil
+}
+
+// Health reports if the crl is unavailable, no client certificates are accepted
+// until it is valid again
+func (a *CertAuth) Health() error {
+	if a.crl == nil {
+		return nil
+	}
+	err := a.crl.check()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	return nil
+}
+
+// Identify maps the verified client certificate of the request to roles
+func (a *CertAuth) Identify(r *http.Request) (core.ACL, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("no verified client certificate")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if a.crl != nil {
+		revoked, err := a.crl.isRevoked(cert)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, fmt.Errorf("client certificate %s is revoked", cert.SerialNumber)
+		}
+	}
+
+	for _, rule := range a.cfg.CertRules {
+		subject, ok := matchCert(rule, cert)
+		if !ok {
+			continue
+		}
+		claims := map[string]interface{}{
+			"sub": subject,
+		}
+		return aclForRoles(a.cfg, rule.Roles, claims), nil
+	}
+	return nil, fmt.Errorf("no rule matches client certificate %s", cert.Subject)
+}
+
+// matchCert checks if the certificate matches the rule and returns the subject of the
+// certificate, the matching URI for SPIFFE IDs and the common name otherwise
+func matchCert(rule *config.CertRule, cert *x509.Certificate) (subject string, ok bool) {
+	subject = cert.Subject.CommonName
+	if rule.CN != nil && !rule.CN.MatchString(cert.Subject.CommonName) {
+		return "", false
+	}
+	if rule.OU != nil {
+		ok = false
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			ok = ok || rule.OU.MatchString(ou)
+		}
+		if !ok {
+			return "", false
+		}
+	}
+	if rule.URI != nil {
+		ok = false
+		for _, uri := range cert.URIs {
+			if rule.URI.MatchString(uri.String()) {
+				subject, ok = uri.String(), true
+				break
+			}
+		}
+		if !ok {
+			return "", false
+		}
+	}
+	return subject, true
+}
+
+// isRevoked checks if the serial of cert is in the revocation list
+func (c *revocationList) isRevoked(cert *x509.Certificate) (bool, error) {
+	err := c.check()
+	if err != nil {
+		return false, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.revoked[cert.SerialNumber.String()], nil
+}
+
+// check reloads the CRL file and checks that it has not expired
+func (c *revocationList) check() error {
+	err := c.load()
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.nextUpdate.IsZero() && time.Now().After(c.nextUpdate) {
+		return fmt.Errorf("crl expired at %s", c.nextUpdate.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// load reads the CRL file if it has been modified, the CRL has to be signed by one
+// of the issuers
+func (c *revocationList) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("unable to read crl: %s", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("unable to read crl: %s", err)
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return fmt.Errorf("unable to parse crl: %s", err)
+	}
+	err = checkCRLSignature(crl, c.issuers)
+	if err != nil {
+		return fmt.Errorf("unable to verify crl: %s", err)
+	}
+	c.nextUpdate = crl.NextUpdate
+	c.revoked = map[string]bool{}
+	for _, entry := range crl.RevokedCertificateEntries {
+		c.revoked[entry.SerialNumber.String()] = true
+	}
+	c.modTime = info.ModTime()
+	return nil
+}
+
+// checkCRLSignature checks that crl is signed by one of the issuers
+func checkCRLSignature(crl *x509.RevocationList, issuers []*x509.Certificate) error {
+	err := fmt.Errorf("no issuer %s in client ca", crl.Issuer)
+	for _, issuer := range issuers {
+		if !bytes.Equal(issuer.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		err = crl.CheckSignatureFrom(issuer)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+func TestCertAuth(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caRaw, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert := func(serial int64, cn string, ou string, uri string) *x509.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: []string{ou}},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		if uri != "" {
+			u, _ := url.Parse(uri)
+			template.URIs = []*url.URL{u}
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	signCRL := func(file string, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, nextUpdate time.Time, serials ...int64) {
+		entries := []x509.RevocationListEntry{}
+		for _, serial := range serials {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		raw, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(int64(len(serials))),
+			RevokedCertificateEntries: entries,
+			ThisUpdate:                nextUpdate.Add(-2 * time.Hour),
+			NextUpdate:                nextUpdate,
+		}, issuer, issuerKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(file, raw, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCRL := func(file string, serials ...int64) {
+		signCRL(file, ca, key, time.Now().Add(time.Hour), serials...)
+	}
+	// crls are only accepted if they are modified, so every update moves the
+	// modification time forward
+	modified := time.Now()
+	touch := func(file string) {
+		modified = modified.Add(time.Minute)
+		err := os.Chtimes(file, modified, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caRaw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(dir, "crl.der")
+	writeCRL(crlFile, 3)
+	cfg := &config.Config{
+		TLSCertFile:     "server.crt",
+		TLSClientCAFile: caFile,
+		TLSCRLFile:      crlFile,
+		ACLMap: config.ACLMap{
+			"developer": &config.ACL{Role: "developer"},
+			"service":   &config.ACL{Role: "service"},
+		},
+		CertRules: []*config.CertRule{
+			{URI: regexp.MustCompile(`^(?:spiffe://example\.com/.*)$`), Roles: []string{"service"}},
+			{CN: regexp.MustCompile(`^(?:.*\.example\.com)$`), OU: regexp.MustCompile(`^(?:dev)$`), Roles: []string{"developer"}},
+		},
+	}
+	a, err := NewCertAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		role    string
+		subject string
+	}{{
+		name:    "cn and ou",
+		cert:    newCert(2, "alice.example.com", "dev", ""),
+		role:    "developer",
+		subject: "alice.example.com",
+	}, {
+		name:    "spiffe",
+		cert:    newCert(4, "worker", "ops", "spiffe://example.com/ns/prod/sa/worker"),
+		role:    "service",
+		subject: "spiffe://example.com/ns/prod/sa/worker",
+	}, {
+		name: "ou mismatch",
+		cert: newCert(5, "bob.example.com", "ops", ""),
+	}, {
+		name: "revoked",
+		cert: newCert(3, "mallory.example.com", "dev", ""),
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{test.cert, ca}}}
+			acl, err := a.Identify(r)
+			if test.role == "" {
+				if err == nil {
+					t.Fatalf("expected error, got acl %+v", acl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity := acl.(core.IdentityACL)
+			if identity.GetRole() != test.role || identity.GetSubject() != test.subject {
+				t.Errorf("expected %s/%s, got %s/%s", test.role, test.subject, identity.GetRole(), identity.GetSubject())
+			}
+		})
+	}
+
+	// requests without verified certificate are not identified
+	_, err = a.Identify(httptest.NewRequest("GET", "/api/v1/query", nil))
+	if err == nil {
+		t.Error("expected error without client certificate")
+	}
+
+	// the crl is re-read when it changes
+	writeCRL(crlFile, 2)
+	touch(crlFile)
+	identify := func(cert *x509.Certificate) error {
+		r := httptest.NewRequest("GET", "/api/v1/query", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca}}}
+		_, err := a.Identify(r)
+		return err
+	}
+	if identify(tests[0].cert) == nil {
+		t.Error("expected revoked certificate after crl update")
+	}
+	err = identify(tests[3].cert)
+	if err != nil {
+		t.Errorf("expected certificate to be valid after crl update: %s", err)
+	}
+	if err = a.Health(); err != nil {
+		t.Errorf("expected healthy crl, got %s", err)
+	}
+
+	// a crl that is not signed by the client ca is rejected
+	forgedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedRaw, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &forgedKey.PublicKey, forgedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := x509.ParseCertificate(forgedRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signCRL(crlFile, forged, forgedKey, time.Now().Add(time.Hour))
+	touch(crlFile)
+	if identify(tests[3].cert) == nil {
+		t.Error("expected forged crl to be rejected")
+	}
+	if err = a.Health(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected forged crl to be unavailable, got %v", err)
+	}
+
+	// an expired crl is unavailable until it is replaced
+	signCRL(crlFile, ca, key, time.Now().Add(-time.Minute))
+	touch(crlFile)
+	if identify(tests[3].cert) == nil {
+		t.Error("expected expired crl to be rejected")
+	}
+	if err = a.Health(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected expired crl to be unavailable, got %v", err)
+	}
+	writeCRL(crlFile)
+	touch(crlFile)
+	if err = identify(tests[3].cert); err != nil {
+		t.Errorf("expected certificate to be valid after crl renewal: %s", err)
+	}
+	if err = a.Health(); err != nil {
+		t.Errorf("expected healthy crl after renewal, got %s", err)
+	}
+}
@@ -3,13 +3,16 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/coreos/go-oidc"
 	"github.com/gorilla/sessions"
@@ -18,7 +21,6 @@ import (
 
 	"github.com/bitsbeats/prometheus-acls/internal/config"
 	"github.com/bitsbeats/prometheus-acls/internal/core"
-	"github.com/bitsbeats/prometheus-acls/internal/prom"
 )
 
 type (
@@ -30,15 +32,29 @@ type (
 
 		store       *sessions.CookieStore
 		oauthConfig *oauth2.Config
+		discovery   *oidcDiscovery
 		verifier    *oidc.IDTokenVerifier
 		authMap     *sync.Map
+
+		// audiences and authorizedParties are the trusted aud and azp claims
+		audiences         []string
+		authorizedParties []string
 	}
 )
 
+// loginTimeout is the time a user has to finish the login
+const loginTimeout = 10 * time.Minute
+
+// loginKeys are the session values of a started login
+var loginKeys = []string{"state", "verifier", "nonce", "return_to", "login_expires"}
+
 // NewOauthAuth creates a new Auth
 func NewOauthAuth(cfg *config.Config, authPath string) (a *OidcAuth, err error) {
 	a = &OidcAuth{}
 	a.cfg = cfg
+	if cfg.OidcIssuer == "" || cfg.OidcClientID == "" || cfg.OidcClientSecret == "" {
+		return nil, fmt.Errorf("unable to setup oidc: OIDC_ISSUER, OIDC_CLIENT_ID and OIDC_CLIENT_SECRET are required")
+	}
 
 	// urls
 	a.loginURL = cfg.URL + path.Join(authPath, "login")
@@ -47,20 +63,21 @@ func NewOauthAuth(cfg *config.Config, authPath string) (a *OidcAuth, err error)
 	// cookie
 	a.store = sessions.NewCookieStore(cfg.CookieSecret)
 
-	// oidc
-	provider, err := oidc.NewProvider(context.Background(), cfg.OidcIssuer)
-	if err != nil {
-		return nil, fmt.Errorf("unable to connect to oidc provider: %s", err)
-	}
+	// oidc, the provider is discovered in the background
+	a.discovery = newOidcDiscovery(cfg.OidcIssuer, cfg.OidcJWKSCache)
 	a.oauthConfig = &oauth2.Config{
 		ClientID:     cfg.OidcClientID,
 		ClientSecret: cfg.OidcClientSecret,
 		RedirectURL:  a.redirectURL,
-		Endpoint:     provider.Endpoint(),
 		Scopes:       []string{oidc.ScopeOpenID},
 	}
-	oidcConfig := &oidc.Config{ClientID: a.oauthConfig.ClientID}
-	a.verifier = provider.Verifier(oidcConfig)
+	oidcConfig := &oidc.Config{
+		// the audiences are checked by verify
+		SkipClientIDCheck: true,
+	}
+	a.verifier = oidc.NewVerifier(cfg.OidcIssuer, a.discovery, oidcConfig)
+	a.audiences = append([]string{cfg.OidcClientID}, cfg.OidcAudiences...)
+	a.authorizedParties = append([]string{cfg.OidcClientID}, cfg.OidcAuthorizedParties...)
 
 	// token store (with cleanup)
 	a.authMap = &sync.Map{}
@@ -95,7 +112,7 @@ func (a OidcAuth) auth(r *http.Request) (t *oidc.IDToken, err error) {
 		// grafanas auth header is preferred
 		auth := authHeader[0]
 		rawIDToken := strings.TrimPrefix(auth, "Bearer ")
-		t, err = a.verifier.Verify(r.Context(), rawIDToken)
+		t, err = a.verify(r.Context(), rawIDToken)
 		if err != nil {
 			return nil, fmt.Errorf("unable to verify oidc token: %s", err)
 		}
@@ -113,14 +130,17 @@ func (a OidcAuth) auth(r *http.Request) (t *oidc.IDToken, err error) {
 		}
 		token := tokenLoader.(*oauth2.Token)
 		if !token.Valid() {
-			var err error
-			token, err = a.oauthConfig.TokenSource(r.Context(), token).Token()
+			oauthConfig, err := a.discoveredConfig()
+			if err != nil {
+				return nil, fmt.Errorf("unable to refresh token: %s", err)
+			}
+			token, err = oauthConfig.TokenSource(r.Context(), token).Token()
 			if err != nil {
 				return nil, fmt.Errorf("unable to refresh token: %s", err)
 			}
 		}
 		rawIDToken := token.AccessToken
-		t, err = a.verifier.Verify(r.Context(), rawIDToken)
+		t, err = a.verify(r.Context(), rawIDToken)
 		if err != nil {
 			return nil, fmt.Errorf("unable to verify oidc token: %s", err)
 		}
@@ -129,6 +149,45 @@ func (a OidcAuth) auth(r *http.Request) (t *oidc.IDToken, err error) {
 	return
 }
 
+// verify verifies the token and checks that it was issued for one of the trusted
+// audiences or authorized parties
+func (a OidcAuth) verify(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
+	t, err := a.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if containsAny(t.Audience, a.audiences) {
+		return t, nil
+	}
+	var claims struct {
+		AuthorizedParty string `json:"azp"`
+	}
+	err = t.Claims(&claims)
+	if err != nil {
+		return nil, err
+	}
+	if claims.AuthorizedParty != "" && containsAny([]string{claims.AuthorizedParty}, a.authorizedParties) {
+		return t, nil
+	}
+	return nil, fmt.Errorf("token for audience %q and authorized party %q is not trusted", t.Audience, claims.AuthorizedParty)
+}
+
+// rolesClaim returns the claim with the roles of the token, the claim of the authorized
+// party is preferred over the claims of the audiences
+func (a OidcAuth) rolesClaim(idToken *oidc.IDToken, claims map[string]interface{}) string {
+	if azp, ok := claims["azp"].(string); ok {
+		if claim, ok := a.cfg.OidcRolesClaims[azp]; ok {
+			return claim
+		}
+	}
+	for _, aud := range idToken.Audience {
+		if claim, ok := a.cfg.OidcRolesClaims[aud]; ok {
+			return claim
+		}
+	}
+	return a.cfg.OidcRolesClaim
+}
+
 func (a OidcAuth) loadACL(idToken *oidc.IDToken) (acl core.ACL, err error) {
 	// add auth to context
 	var claimsLoader interface{}
@@ -140,45 +199,65 @@ func (a OidcAuth) loadACL(idToken *oidc.IDToken) (acl core.ACL, err error) {
 	if !ok {
 		return nil, fmt.Errorf("unable to cast access token claims")
 	}
-	roles, ok := claimsMap[a.cfg.OidcRolesClaim].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("unable to load acces token claims from %s", a.cfg.OidcRolesClaim)
-	}
-	for _, role := range roles {
-		var ok bool
-		role, ok := role.(string)
-		if !ok {
-			continue
-		}
-		acl, ok = a.cfg.ACLMap.GetACL(role)
-		if ok {
-			break
-		}
+	roleNames, err := claimRoles(claimsMap, a.rolesClaim(idToken, claimsMap))
+	if err != nil {
+		return nil, err
 	}
-	if acl == nil {
-		acl = a.cfg.ACLMap.GetDenyACL()
+	return aclForRoles(a.cfg, roleNames, claimsMap), nil
+}
+
+// discoveredConfig returns the oauth2.Config with the endpoint of the discovered
+// provider
+func (a OidcAuth) discoveredConfig() (*oauth2.Config, error) {
+	endpoint, err := a.discovery.Endpoint()
+	if err != nil {
+		return nil, err
 	}
-	return
+	oauthConfig := *a.oauthConfig
+	oauthConfig.Endpoint = endpoint
+	return &oauthConfig, nil
 }
 
-// redirectErrorHandler redirects the user to a.loginURL and logs the message
-func (a OidcAuth) redirectErrorHandler(w http.ResponseWriter, r *http.Request, msg string, code int) {
-	http.Redirect(w, r, a.loginURL, http.StatusTemporaryRedirect)
-	return
+// Health reports if the oidc provider is degraded or unavailable
+func (a OidcAuth) Health() error {
+	return a.discovery.Health()
+}
+
+// LoginURL returns the URL of the LoginHandler
+func (a OidcAuth) LoginURL() string {
+	return a.loginURL
 }
 
-// LoginHandler is the HTTP route for the login
+// LoginHandler is the HTTP route for the login. The URL of the return_to parameter
+// is restored after the login
 func (a OidcAuth) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	oauthConfig, err := a.discoveredConfig()
+	if err != nil {
+		log.WithError(err).Error("unable to start login")
+		http.Error(w, "oidc provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	session, _ := a.store.Get(r, SESSIONNAME)
-	stateBytes := make([]byte, 32)
-	_, err := rand.Read(stateBytes)
+	state, err := randomString()
 	if err != nil {
 		log.WithError(err).Error("unable to generate oauth state")
 		http.Error(w, "unable to generate oauth state", http.StatusInternalServerError)
 		return
 	}
-	store := base64.StdEncoding.EncodeToString(stateBytes)
-	session.Values["state"] = store
+	nonce, err := randomString()
+	if err != nil {
+		log.WithError(err).Error("unable to generate oidc nonce")
+		http.Error(w, "unable to generate oidc nonce", http.StatusInternalServerError)
+		return
+	}
+	// the login is kept in the signed session cookie until the callback, so it
+	// does not depend on the replica or the process that started it
+	verifier := oauth2.GenerateVerifier()
+	session.Values["state"] = state
+	session.Values["verifier"] = verifier
+	session.Values["nonce"] = nonce
+	session.Values["return_to"] = safeReturnTo(r.FormValue("return_to"))
+	session.Values["login_expires"] = time.Now().Add(loginTimeout).Unix()
 	err = session.Save(r, w)
 	if err != nil {
 		log.WithError(err).Error("unable to store session")
@@ -186,7 +265,7 @@ func (a OidcAuth) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	url := a.oauthConfig.AuthCodeURL(store)
+	url := oauthConfig.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce))
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
@@ -202,8 +281,26 @@ func (a OidcAuth) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "oauth state invalid", http.StatusForbidden)
 		return
 	}
+	verifier, _ := session.Values["verifier"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	returnTo, _ := session.Values["return_to"].(string)
+	expires, _ := session.Values["login_expires"].(int64)
+	// the state is only valid once
+	for _, key := range loginKeys {
+		delete(session.Values, key)
+	}
+	if verifier == "" || time.Now().After(time.Unix(expires, 0)) {
+		http.Error(w, "oauth state already used or expired", http.StatusForbidden)
+		return
+	}
+	oauthConfig, err := a.discoveredConfig()
+	if err != nil {
+		log.WithError(err).Error("unable to finish login")
+		http.Error(w, "oidc provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	code := r.FormValue("code")
-	token, err := a.oauthConfig.Exchange(r.Context(), code)
+	token, err := oauthConfig.Exchange(r.Context(), code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		log.WithError(err).Error("unable to exchange oauth token")
 		http.Error(w, "unable to exchange oauth token", http.StatusForbidden)
@@ -216,10 +313,14 @@ func (a OidcAuth) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	idToken, err := a.verifier.Verify(r.Context(), rawIDToken)
-	if err != nil {
+	if err != nil || !containsAny(idToken.Audience, []string{a.oauthConfig.ClientID}) {
 		http.Error(w, "unable to verify id_token", http.StatusForbidden)
 		return
 	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		http.Error(w, "oidc nonce invalid", http.StatusForbidden)
+		return
+	}
 	session.Values["subject"] = idToken.Subject
 	a.authMap.Store(idToken.Subject, token)
 	err = session.Save(r, w)
@@ -229,26 +330,46 @@ func (a OidcAuth) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	http.Redirect(w, r, safeReturnTo(returnTo), http.StatusTemporaryRedirect)
 }
 
-// Middleware verifies the token and redirects to login
-func (a OidcAuth) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idToken, err := a.auth(r)
-		if err != nil {
-			prom.SendError(w, r, err.Error(), http.StatusBadRequest, a.redirectErrorHandler)
-			return
-		}
-		acl, err := a.loadACL(idToken)
-		if err != nil {
-			log.WithError(err).Error("unable to load acl")
-			prom.SendError(w, r, "unable to load acl", http.StatusBadRequest, a.redirectErrorHandler)
-			return
-		}
-		r = r.WithContext(context.WithValue(r.Context(), "acl", acl))
+// randomString generates a random url safe string
+func randomString() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// safeReturnTo returns returnTo if it is a path on this host, "/" otherwise to
+// prevent open redirects
+func safeReturnTo(returnTo string) string {
+	// browsers treat backslashes like slashes and strip control characters, e.g.
+	// "/\evil.com" or "/\t/evil.com"
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		return "/"
+	}
+	if strings.Contains(returnTo, "\\") || strings.IndexFunc(returnTo, unicode.IsControl) >= 0 {
+		return "/"
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return returnTo
+}
 
-		// handle request
-		next.ServeHTTP(w, r)
-	})
+// Identify verifies the token of the request
+func (a OidcAuth) Identify(r *http.Request) (core.ACL, error) {
+	idToken, err := a.auth(r)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := a.loadACL(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load acl: %s", err)
+	}
+	return acl, nil
 }
@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// oidcStub is a minimal oidc provider, codes are exchanged for tokens with the claims
+// of the code
+type oidcStub struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mutex sync.Mutex
+	codes map[string]oidcStubCode
+}
+
+type oidcStubCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newOidcStub(t *testing.T) (s *oidcStub) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &oidcStub{key: key, codes: map[string]oidcStubCode{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "%[1]s/auth", "token_endpoint": "%[1]s/token", "jwks_uri": "%[1]s/jwks"}`, s.URL)
+		case "/jwks":
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "1", Algorithm: "RS256"}}})
+		case "/token":
+			s.mutex.Lock()
+			code, ok := s.codes[r.PostFormValue("code")]
+			delete(s.codes, r.PostFormValue("code"))
+			s.mutex.Unlock()
+			challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+			if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant"}`)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": s.sign(t, code.claims),
+				"id_token":     s.sign(t, code.claims),
+				"token_type":   "Bearer",
+				"expires_in":   3600,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return
+}
+
+// authorize issues a code for the authorization request and claims
+func (s *oidcStub) authorize(authURL *url.URL, claims map[string]interface{}) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	code := fmt.Sprintf("code-%d", len(s.codes))
+	s.codes[code] = oidcStubCode{challenge: authURL.Query().Get("code_challenge"), claims: claims}
+	return code
+}
+
+// sign signs claims, the iss and exp claims are set if missing
+func (s *oidcStub) sign(t *testing.T, claims map[string]interface{}) string {
+	signed := map[string]interface{}{
+		"iss": s.URL,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for key, value := range claims {
+		signed[key] = value
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: s.key}, (&jose.SignerOptions{}).WithHeader("kid", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(signed)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := jws.CompactSerialize()
+	return token
+}
+
+// newTestOidcAuth creates a OidcAuth for the stub and waits for the discovery
+func newTestOidcAuth(t *testing.T, s *oidcStub, cfg *config.Config) *OidcAuth {
+	cfg.URL = "http://localhost:8080"
+	cfg.OidcIssuer = s.URL
+	cfg.OidcClientID = "promacl"
+	cfg.OidcClientSecret = "secret"
+	cfg.OidcRolesClaim = "roles"
+	cfg.CookieSecret = make([]byte, 32)
+	cfg.ACLMap = config.ACLMap{
+		"developer": &config.ACL{Role: "developer"},
+		"admin":     &config.ACL{Role: "admin"},
+	}
+	a, err := NewOauthAuth(cfg, "/oauth/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200 && a.Health() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := a.Health(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestOidcAudiences(t *testing.T) {
+	s := newOidcStub(t)
+	defer s.Close()
+	a := newTestOidcAuth(t, s, &config.Config{
+		OidcAudiences:         []string{"grafana"},
+		OidcAuthorizedParties: []string{"promcli"},
+		OidcRolesClaims:       map[string]string{"promcli": "groups"},
+	})
+
+	sign := func(aud interface{}, azp string) string {
+		claims := map[string]interface{}{
+			"sub":    "alice",
+			"aud":    aud,
+			"roles":  []string{"developer"},
+			"groups": []string{"admin"},
+		}
+		if azp != "" {
+			claims["azp"] = azp
+		}
+		return s.sign(t, claims)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		role  string
+	}{
+		{"own client", sign("promacl", ""), "developer"},
+		{"trusted audience", sign([]string{"account", "grafana"}, "grafana"), "developer"},
+		{"trusted authorized party", sign("account", "promcli"), "admin"},
+		{"own authorized party", sign("account", "promacl"), "developer"},
+		{"untrusted audience", sign("other", ""), ""},
+		{"untrusted authorized party", sign("account", "other"), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			acl, err := a.Identify(r)
+			if test.role == "" {
+				if err == nil {
+					t.Fatalf("expected error, got acl %+v", acl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if role := acl.(core.IdentityACL).GetRole(); role != test.role {
+				t.Errorf("expected role %s, got %s", test.role, role)
+			}
+		})
+	}
+}
+
+func TestOidcLogin(t *testing.T) {
+	s := newOidcStub(t)
+	defer s.Close()
+	a := newTestOidcAuth(t, s, &config.Config{})
+
+	// login starts the authorization code flow with pkce and nonce
+	login := func(returnTo string) (authURL *url.URL, cookies []*http.Cookie) {
+		r := httptest.NewRequest("GET", "/oauth/login?"+url.Values{"return_to": {returnTo}}.Encode(), nil)
+		w := httptest.NewRecorder()
+		a.LoginHandler(w, r)
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expected redirect, got %d: %s", w.Code, w.Body.String())
+		}
+		authURL, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := authURL.Query()
+		if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("nonce") == "" {
+			t.Fatalf("expected pkce and nonce in %s", authURL)
+		}
+		return authURL, w.Result().Cookies()
+	}
+	callback := func(state string, code string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/oauth/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		a.CallbackHandler(w, r)
+		return w
+	}
+	claims := func(nonce string) map[string]interface{} {
+		return map[string]interface{}{"sub": "alice", "aud": "promacl", "nonce": nonce, "roles": []string{"developer"}}
+	}
+
+	// the original url is restored
+	authURL, cookies := login("/graph?g0.expr=up")
+	state, nonce := authURL.Query().Get("state"), authURL.Query().Get("nonce")
+	w := callback(state, s.authorize(authURL, claims(nonce)), cookies)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/graph?g0.expr=up" {
+		t.Fatalf("expected redirect to original url, got %d %q: %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+
+	// the state is only valid once
+	w = callback(state, s.authorize(authURL, claims(nonce)), w.Result().Cookies())
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected reused state to be rejected, got %d", w.Code)
+	}
+
+	// the login is finished by another replica
+	authURL, cookies = login("/graph")
+	replica := newTestOidcAuth(t, s, &config.Config{})
+	r := httptest.NewRequest("GET", "/oauth/callback?"+url.Values{"state": {authURL.Query().Get("state")}, "code": {s.authorize(authURL, claims(authURL.Query().Get("nonce")))}}.Encode(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	replica.CallbackHandler(w, r)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/graph" {
+		t.Errorf("expected login to finish on another replica, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the nonce must match
+	authURL, cookies = login("/")
+	w = callback(authURL.Query().Get("state"), s.authorize(authURL, claims("other")), cookies)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected invalid nonce to be rejected, got %d", w.Code)
+	}
+
+	// the code is bound to the pkce challenge of the login
+	authURL, cookies = login("/")
+	otherURL, _ := login("/")
+	w = callback(authURL.Query().Get("state"), s.authorize(otherURL, claims(authURL.Query().Get("nonce"))), cookies)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected code of other login to be rejected, got %d", w.Code)
+	}
+
+	// open redirects are prevented
+	for _, returnTo := range []string{"https://evil.com/", "//evil.com/", "/\\evil.com", "/\t/evil.com", "evil.com", ""} {
+		authURL, cookies := login(returnTo)
+		w := callback(authURL.Query().Get("state"), s.authorize(authURL, claims(authURL.Query().Get("nonce"))), cookies)
+		if w.Header().Get("Location") != "/" {
+			t.Errorf("expected redirect to / for %q, got %d %q", returnTo, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -2,12 +2,16 @@ package config
 
 import (
 	"fmt"
-	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/model/labels"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 
+	"github.com/bitsbeats/prometheus-acls/internal/core"
 	"github.com/bitsbeats/prometheus-acls/internal/labeler"
 )
 
@@ -18,19 +22,88 @@ type (
 	// MetricName is a string to identify a Prometheus metric
 	MetricName string
 
-	// NamedACL hold the LabelMatchers for a specific MetricName
-	NamedACL map[MetricName][]*labels.Matcher
+	// Rule holds the restrictions for a metric
+	Rule struct {
+		LabelMatchers []*labels.Matcher
+		AggregateBy   []string
+		Owner         *OwnerRule
+		Upstream      string
+	}
+
+	// ruleLoad is the yaml representation of a Rule
+	ruleLoad struct {
+		Labels      interface{} `yaml:"labels"`
+		AggregateBy []string    `yaml:"aggregate_by"`
+		Owner       *ownerLoad  `yaml:"owner"`
+		Upstream    string      `yaml:"upstream"`
+	}
+
+	// NamedACL hold the Rule for a specific MetricName
+	NamedACL map[MetricName]*Rule
 
-	// RegexACL holds the LabelMatchers for all MetricNames that match Regexp
+	// RegexACL holds the Rule for all MetricNames that match Regexp
 	RegexACL struct {
-		Regexp        *regexp.Regexp
-		LabelMatchers []*labels.Matcher
+		Regexp *regexp.Regexp
+		*Rule
+	}
+
+	// RedactRule configures the Redaction of a label
+	RedactRule struct {
+		Label       string `yaml:"label"`
+		Action      string `yaml:"action"`
+		Replacement string `yaml:"replacement"`
+	}
+
+	// Limits configures the core.Limits of a role
+	Limits struct {
+		MaxRange         model.Duration `yaml:"max_range"`
+		MinStep          model.Duration `yaml:"min_step"`
+		MaxSelectors     int            `yaml:"max_selectors"`
+		MaxSubqueryDepth int            `yaml:"max_subquery_depth"`
+		MaxPoints        int64          `yaml:"max_points"`
+	}
+
+	// Functions configures the core.FunctionPolicy of a role
+	Functions struct {
+		Allow    []string                  `yaml:"allow"`
+		Deny     []string                  `yaml:"deny"`
+		MaxRange map[string]model.Duration `yaml:"max_range"`
+	}
+
+	// RateLimit configures a core.RateLimit
+	RateLimit struct {
+		RequestsPerSecond float64 `yaml:"requests_per_second"`
+		Burst             int     `yaml:"burst"`
+		MaxInFlight       int     `yaml:"max_in_flight"`
+	}
+
+	// RateLimits configures the core.RateLimit per role and per subject
+	RateLimits struct {
+		Role    RateLimit `yaml:"role"`
+		Subject RateLimit `yaml:"subject"`
+	}
+
+	// Options holds the role wide settings of an ACL
+	Options struct {
+		ForbiddenLabels []string       `yaml:"forbidden_labels"`
+		Redact          []RedactRule   `yaml:"redact"`
+		MaxLookback     model.Duration `yaml:"max_lookback"`
+		NotBefore       time.Time      `yaml:"not_before"`
+		Limits          Limits         `yaml:"limits"`
+		Functions       Functions      `yaml:"functions"`
+		RateLimit       RateLimits     `yaml:"rate_limit"`
+		Upstream        string         `yaml:"upstream"`
+		Tenants         []string       `yaml:"tenants"`
 	}
 
 	// ACL holds the parsed Named and Regex metricName to LabelMatchers
 	ACL struct {
-		Named NamedACL
-		Regex []RegexACL
+		Role    OidcRole
+		Named   NamedACL
+		Regex   []RegexACL
+		Options Options
+
+		redactions map[string]core.Redaction
 	}
 
 	// ACLMap is used to look up OidcRole for its configures ACL
@@ -40,6 +113,13 @@ type (
 // None is a special LabelMatcher that matches for no metric, used to deny access to a metric
 var None = labeler.MustParseLabels("__=\"none\"")
 
+// OptionsKey is the key in a role that holds the Options instead of a metric. The
+// prefix "__" is reserved by Prometheus, so it never collides with a metric name
+const OptionsKey = "__options__"
+
+// NoneRule is the Rule used for metrics without configured access
+var NoneRule = &Rule{LabelMatchers: None}
+
 // GetACL fetches the ACLs for a specific OidcRole
 func (a ACLMap) GetACL(role string) (*ACL, bool) {
 	acl, ok := a[OidcRole(role)]
@@ -52,11 +132,11 @@ func (a ACLMap) GetDenyACL() *ACL {
 }
 
 // ParseAndStoreACL parses the metricName if its a NamedACL or a RegexACL and the query
-// for all supported query types (see parseLabels)
+// for all supported query types (see parseRule)
 func (a *ACL) ParseAndStoreACL(metricName string, query interface{}) (err error) {
-	lm, err := a.parseLabels(query)
+	rule, err := a.parseRule(query)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to parse rule for %s: %s", metricName, err)
 	}
 	if strings.HasPrefix(metricName, "re!") {
 		expr := strings.TrimPrefix(metricName, "re!")
@@ -70,37 +150,173 @@ func (a *ACL) ParseAndStoreACL(metricName string, query interface{}) (err error)
 			return err
 		}
 		a.Regex = append(a.Regex, RegexACL{
-			Regexp:        r,
-			LabelMatchers: lm,
+			Regexp: r,
+			Rule:   rule,
 		})
 	}
-	a.Named[MetricName(metricName)] = lm
+	a.Named[MetricName(metricName)] = rule
 	return
 }
 
-// GetLabelMatchers checks in order against exact the NamedACL, a RegexACL and the
-// fallback '*' ACL and returns the corresponding LabelMatchers
-func (a *ACL) GetLabelMatchers(metricName string) []*labels.Matcher {
-	labelMatchers, ok := a.Named[MetricName(metricName)]
+// ParseAndStoreOptions parses the role wide Options
+func (a *ACL) ParseAndStoreOptions(options interface{}) (err error) {
+	err = remarshal(options, &a.Options)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %s", OptionsKey, err)
+	}
+	a.redactions = map[string]core.Redaction{}
+	for _, rule := range a.Options.Redact {
+		switch rule.Action {
+		case core.RedactDrop, core.RedactReplace, core.RedactHMAC:
+		default:
+			return fmt.Errorf("unable to parse %s: redact action %q is not one of drop, replace or hmac", OptionsKey, rule.Action)
+		}
+		if rule.Label == "" || rule.Label == "__name__" {
+			return fmt.Errorf("unable to parse %s: redact label %q is invalid", OptionsKey, rule.Label)
+		}
+		a.redactions[rule.Label] = core.Redaction{
+			Action:      rule.Action,
+			Replacement: rule.Replacement,
+		}
+	}
+	for _, tenant := range a.Options.Tenants {
+		if tenant == "" || strings.Contains(tenant, "|") {
+			return fmt.Errorf("unable to parse %s: tenant %q is invalid", OptionsKey, tenant)
+		}
+	}
+	return
+}
+
+// GetRule checks in order against exact the NamedACL, a RegexACL and the
+// fallback '*' ACL and returns the corresponding Rule
+func (a *ACL) GetRule(metricName string) *Rule {
+	rule, ok := a.Named[MetricName(metricName)]
 	if ok {
-		log.WithField("labelMatchers", labelMatchers).Debug("added labels")
-		return labelMatchers
+		return rule
 	}
 	for _, racl := range a.Regex {
 		if racl.Regexp.MatchString(metricName) {
-			return racl.LabelMatchers
+			return racl.Rule
 		}
 	}
-	labelMatchers, ok = a.Named["*"]
+	rule, ok = a.Named["*"]
 	if ok {
-		log.WithField("labelMatchers", labelMatchers).Debug("added labels")
-		return labelMatchers
+		return rule
 	}
-	labelMatchers = None
+	return NoneRule
+}
+
+// GetLabelMatchers returns the LabelMatchers of the Rule for metricName
+func (a *ACL) GetLabelMatchers(metricName string) []*labels.Matcher {
+	labelMatchers := a.GetRule(metricName).LabelMatchers
 	log.WithField("labelMatchers", labelMatchers).Debug("added labels")
 	return labelMatchers
 }
 
+// GetAggregationLabels returns the labels metricName may be grouped by if the
+// metric may only be queried aggregated
+func (a *ACL) GetAggregationLabels(metricName string) ([]string, bool) {
+	aggregateBy := a.GetRule(metricName).AggregateBy
+	return aggregateBy, aggregateBy != nil
+}
+
+// HasAggregations checks if any metric may only be queried aggregated
+func (a *ACL) HasAggregations() bool {
+	return a.hasRule(func(rule *Rule) bool { return rule.AggregateBy != nil })
+}
+
+// hasRule checks if any Rule matches
+func (a *ACL) hasRule(match func(*Rule) bool) bool {
+	for _, rule := range a.Named {
+		if match(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetForbiddenLabels returns the labels that may not be used for grouping or matching
+func (a *ACL) GetForbiddenLabels() []string {
+	return a.Options.ForbiddenLabels
+}
+
+// GetRedactions returns the Redaction for each redacted label
+func (a *ACL) GetRedactions() map[string]core.Redaction {
+	return a.redactions
+}
+
+// GetTimeRestrictions returns the maximum lookback and the earliest time for queries
+func (a *ACL) GetTimeRestrictions() (time.Duration, time.Time) {
+	return time.Duration(a.Options.MaxLookback), a.Options.NotBefore
+}
+
+// GetLimits returns the Limits for queries
+func (a *ACL) GetLimits() core.Limits {
+	return core.Limits{
+		MaxRange:         time.Duration(a.Options.Limits.MaxRange),
+		MinStep:          time.Duration(a.Options.Limits.MinStep),
+		MaxSelectors:     a.Options.Limits.MaxSelectors,
+		MaxSubqueryDepth: a.Options.Limits.MaxSubqueryDepth,
+		MaxPoints:        a.Options.Limits.MaxPoints,
+	}
+}
+
+// GetFunctionPolicy returns the FunctionPolicy for queries
+func (a *ACL) GetFunctionPolicy() core.FunctionPolicy {
+	maxRange := map[string]time.Duration{}
+	for function, d := range a.Options.Functions.MaxRange {
+		maxRange[function] = time.Duration(d)
+	}
+	return core.FunctionPolicy{
+		Allow:    a.Options.Functions.Allow,
+		Deny:     a.Options.Functions.Deny,
+		MaxRange: maxRange,
+	}
+}
+
+// GetRateLimits returns the RateLimit per role and per subject
+func (a *ACL) GetRateLimits() (core.RateLimit, core.RateLimit) {
+	return core.RateLimit(a.Options.RateLimit.Role), core.RateLimit(a.Options.RateLimit.Subject)
+}
+
+// GetTenants returns the tenants the role may query
+func (a *ACL) GetTenants() []string {
+	return a.Options.Tenants
+}
+
+// parseRule parses the query and returns the resulting Rule. Supports all queries
+// of parseLabels and a map with the keys of ruleLoad
+func (a *ACL) parseRule(query interface{}) (rule *Rule, err error) {
+	load := ruleLoad{Labels: query}
+	if casted, ok := query.(map[interface{}]interface{}); ok {
+		load = ruleLoad{}
+		err = remarshal(casted, &load)
+		if err != nil {
+			return nil, err
+		}
+		if load.Labels == nil {
+			// a rule without labels has no label restrictions
+			load.Labels = ""
+		}
+	}
+	lm, err := a.parseLabels(load.Labels)
+	if err != nil {
+		return nil, err
+	}
+	rule = &Rule{
+		LabelMatchers: lm,
+		AggregateBy:   load.AggregateBy,
+		Upstream:      load.Upstream,
+	}
+	if load.Owner != nil {
+		rule.Owner, err = parseOwner(load.Owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
 // parseLabels parses the query and returns the resulting LabelMatchers. Currently supports
 // nil, empty string and prometheus label query as query
 func (a *ACL) parseLabels(query interface{}) (lm []*labels.Matcher, err error) {
@@ -120,3 +336,12 @@ func (a *ACL) parseLabels(query interface{}) (lm []*labels.Matcher, err error) {
 	}
 	return
 }
+
+// remarshal decodes a generic yaml value into out
+func remarshal(in interface{}, out interface{}) error {
+	raw, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(raw, out)
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// APIKey is a static key of a service account that is mapped to roles
+	APIKey struct {
+		Name        string
+		Description string    `yaml:"description"`
+		Hash        string    `yaml:"hash"`
+		Roles       []string  `yaml:"roles"`
+		Expires     time.Time `yaml:"expires"`
+	}
+
+	// APIKeyMap is used to look up an APIKey by its name
+	APIKeyMap map[string]*APIKey
+)
+
+// apiKeyName matches the valid names of an APIKey, the name must not contain the
+// separator of name and secret
+var apiKeyName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// parseAPIKeys loads the api keys from file
+func parseAPIKeys(file string) (keys APIKeyMap, err error) {
+	keys = APIKeyMap{}
+	if file == "" {
+		return keys, nil
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open api keys: %s", err)
+	}
+	defer fp.Close()
+	decoder := yaml.NewDecoder(fp)
+	decoder.SetStrict(true)
+	err = decoder.Decode(&keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load api keys: %s", err)
+	}
+	for name, key := range keys {
+		if !apiKeyName.MatchString(name) {
+			return nil, fmt.Errorf("unable to load api key %s: name must match %s", name, apiKeyName)
+		}
+		if !strings.HasPrefix(key.Hash, "$2") && !strings.HasPrefix(key.Hash, "$argon2") {
+			return nil, fmt.Errorf("unable to load api key %s: hash is neither bcrypt nor argon2", name)
+		}
+		if len(key.Roles) == 0 {
+			return nil, fmt.Errorf("unable to load api key %s: no roles configured", name)
+		}
+		key.Name = name
+	}
+	return
+}
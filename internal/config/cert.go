@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// CertRule maps client certificates to roles, all configured expressions must match
+	CertRule struct {
+		CN    *regexp.Regexp
+		OU    *regexp.Regexp
+		URI   *regexp.Regexp
+		Roles []string
+	}
+
+	// certRuleLoad is the yaml representation of a CertRule
+	certRuleLoad struct {
+		CN    string   `yaml:"cn"`
+		OU    string   `yaml:"ou"`
+		URI   string   `yaml:"uri"`
+		Roles []string `yaml:"roles"`
+	}
+)
+
+// parseCertRules loads the client certificate rules from file
+func parseCertRules(file string) (rules []*CertRule, err error) {
+	if file == "" {
+		return nil, nil
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open client certificate rules: %s", err)
+	}
+	defer fp.Close()
+	loads := []certRuleLoad{}
+	decoder := yaml.NewDecoder(fp)
+	decoder.SetStrict(true)
+	err = decoder.Decode(&loads)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load client certificate rules: %s", err)
+	}
+	for i, load := range loads {
+		if load.CN == "" && load.OU == "" && load.URI == "" {
+			return nil, fmt.Errorf("unable to load client certificate rule %d: one of cn, ou or uri is required", i)
+		}
+		if len(load.Roles) == 0 {
+			return nil, fmt.Errorf("unable to load client certificate rule %d: no roles configured", i)
+		}
+		rule := &CertRule{Roles: load.Roles}
+		for _, expr := range []struct {
+			raw  string
+			into **regexp.Regexp
+		}{{load.CN, &rule.CN}, {load.OU, &rule.OU}, {load.URI, &rule.URI}} {
+			if expr.raw == "" {
+				continue
+			}
+			// expressions are anchored to match the complete value
+			*expr.into, err = regexp.Compile("^(?:" + expr.raw + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("unable to load client certificate rule %d: %s", i, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
@@ -4,7 +4,9 @@ import (
 	"crypto/rand"
 	"fmt"
 	"github.com/kelseyhightower/envconfig"
+	"net"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -16,13 +18,58 @@ type (
 		Listen        string `envconfig:"LISTEN" default:":8080"`
 		URL           string `envconfig:"URL" default:"http://localhost:8080"`
 		PrometheusURL string `envconfig:"PROMETHEUS_URL" default:"http://localhost:9090"`
+		UpstreamFile  string `envconfig:"UPSTREAM_FILE"`
+		Upstreams     UpstreamMap
 		CookieSecret  []byte `envconfig:"COOKIE_SECRET"`
 
-		AuthProvider     string `envconfig:"AUTH_PROVIDER" default:"oidc"`
-		OidcIssuer       string `envconfig:"OIDC_ISSUER" required:"true"`
-		OidcClientID     string `envconfig:"OIDC_CLIENT_ID" required:"true"`
-		OidcClientSecret string `envconfig:"OIDC_CLIENT_SECRET" required:"true"`
-		OidcRolesClaim   string `envconfig:"OIDC_ROLES_CLAIM" default:"roles"`
+		AuthProviders    []string `envconfig:"AUTH_PROVIDER" default:"oidc"`
+		OidcIssuer       string   `envconfig:"OIDC_ISSUER"`
+		OidcClientID     string   `envconfig:"OIDC_CLIENT_ID"`
+		OidcClientSecret string   `envconfig:"OIDC_CLIENT_SECRET"`
+		OidcRolesClaim   string   `envconfig:"OIDC_ROLES_CLAIM" default:"roles"`
+		OidcJWKSCache    string   `envconfig:"OIDC_JWKS_CACHE_FILE"`
+
+		OidcAudiences         []string          `envconfig:"OIDC_AUDIENCES"`
+		OidcAuthorizedParties []string          `envconfig:"OIDC_AUTHORIZED_PARTIES"`
+		OidcRolesClaims       map[string]string `envconfig:"OIDC_ROLES_CLAIMS"`
+
+		IntrospectionURL          string `envconfig:"INTROSPECTION_URL"`
+		IntrospectionClientID     string `envconfig:"INTROSPECTION_CLIENT_ID"`
+		IntrospectionClientSecret string `envconfig:"INTROSPECTION_CLIENT_SECRET"`
+		IntrospectionRolesClaim   string `envconfig:"INTROSPECTION_ROLES_CLAIM" default:"roles"`
+
+		JWTKeysFile   string        `envconfig:"JWT_KEYS_FILE"`
+		JWTIssuer     string        `envconfig:"JWT_ISSUER"`
+		JWTAudiences  []string      `envconfig:"JWT_AUDIENCES"`
+		JWTAlgorithms []string      `envconfig:"JWT_ALGORITHMS" default:"RS256"`
+		JWTClockSkew  time.Duration `envconfig:"JWT_CLOCK_SKEW" default:"30s"`
+		JWTRolesClaim string        `envconfig:"JWT_ROLES_CLAIM" default:"roles"`
+
+		TLSCertFile        string `envconfig:"TLS_CERT_FILE"`
+		TLSKeyFile         string `envconfig:"TLS_KEY_FILE"`
+		TLSClientCAFile    string `envconfig:"TLS_CLIENT_CA_FILE"`
+		TLSCRLFile         string `envconfig:"TLS_CRL_FILE"`
+		TLSClientRulesFile string `envconfig:"TLS_CLIENT_RULES_FILE"`
+		CertRules          []*CertRule
+
+		TrustedUserHeader    string            `envconfig:"TRUSTED_USER_HEADER" default:"X-Forwarded-User"`
+		TrustedGroupsHeader  string            `envconfig:"TRUSTED_GROUPS_HEADER" default:"X-Forwarded-Groups"`
+		TrustedProxies       []string          `envconfig:"TRUSTED_PROXIES"`
+		TrustedSecretHeader  string            `envconfig:"TRUSTED_SECRET_HEADER" default:"X-Proxy-Secret"`
+		TrustedSecret        string            `envconfig:"TRUSTED_SECRET"`
+		TrustedGroupRoles    map[string]string `envconfig:"TRUSTED_GROUP_ROLES"`
+		TrustedGroupsAsRoles bool              `envconfig:"TRUSTED_GROUPS_AS_ROLES"`
+		TrustedNetworks      []*net.IPNet
+
+		HtpasswdFile      string `envconfig:"HTPASSWD_FILE"`
+		HtpasswdRolesFile string `envconfig:"HTPASSWD_ROLES_FILE"`
+		HtpasswdRealm     string `envconfig:"HTPASSWD_REALM" default:"prometheus-acls"`
+
+		APIKeysFile  string `envconfig:"API_KEYS_FILE"`
+		APIKeyHeader string `envconfig:"API_KEY_HEADER" default:"X-API-Key"`
+		APIKeys      APIKeyMap
+
+		RedactionKey []byte `envconfig:"REDACTION_KEY"`
 
 		ACLFile string `envconfig:"ACL_FILE" default:"prometheus-acls.yml"`
 		ACLMap  ACLMap
@@ -54,6 +101,39 @@ func Parse() (c *Config, err error) {
 		return nil, fmt.Errorf("unable to use provided secret key with %d bytes, use 32 or 64", l)
 	}
 
+	if len(c.RedactionKey) == 0 {
+		log.Warn("no redaction key provided, generating a random one")
+		c.RedactionKey = make([]byte, 32)
+		_, err = rand.Read(c.RedactionKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate redaction key: %s", err)
+		}
+	}
+
+	// handle api keys
+	c.APIKeys, err = parseAPIKeys(c.APIKeysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle client certificate rules
+	c.CertRules, err = parseCertRules(c.TLSClientRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle trusted proxies
+	c.TrustedNetworks, err = parseNetworks(c.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle upstreams
+	c.Upstreams, err = parseUpstreams(c.UpstreamFile, c.PrometheusURL)
+	if err != nil {
+		return nil, err
+	}
+
 	// handle config
 	fp, err := os.Open(c.ACLFile)
 	if err != nil {
@@ -70,17 +150,29 @@ func Parse() (c *Config, err error) {
 		_, ok := c.ACLMap[role]
 		if !ok {
 			c.ACLMap[role] = &ACL{
+				Role:  role,
 				Named: NamedACL{},
 				Regex: []RegexACL{},
 			}
 		}
 		loadInto := c.ACLMap[role]
 		for metricName, query := range aclLoad {
+			if metricName == OptionsKey {
+				err = loadInto.ParseAndStoreOptions(query)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
 			err = loadInto.ParseAndStoreACL(metricName, query)
 			if err != nil {
 				return nil, err
 			}
 		}
+		err = loadInto.checkUpstreams(c.Upstreams)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return
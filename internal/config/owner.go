@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type (
+	// OwnerRule restricts a metric to the series that share the On labels with the
+	// Selector. Matcher values of the form $<claim> are replaced with the users claim
+	OwnerRule struct {
+		Selector *parser.VectorSelector
+		On       []string
+	}
+
+	// ownerLoad is the yaml representation of an OwnerRule
+	ownerLoad struct {
+		Selector string   `yaml:"selector"`
+		On       []string `yaml:"on"`
+	}
+)
+
+// claimPlaceholder matches matcher values that are replaced by a claim
+var claimPlaceholder = regexp.MustCompile(`^\$([a-zA-Z_][a-zA-Z0-9_]*)$`)
+
+// GetOwner returns the Owner of metricName without any claims
+func (a *ACL) GetOwner(metricName string) (*core.Owner, bool) {
+	return a.getOwner(metricName, nil)
+}
+
+// GetOwner returns the Owner of metricName with the placeholders replaced by the
+// users claims
+func (u *UserACL) GetOwner(metricName string) (*core.Owner, bool) {
+	return u.getOwner(metricName, u.claims)
+}
+
+// HasOwners checks if any metric is restricted by ownership
+func (a *ACL) HasOwners() bool {
+	return a.hasRule(func(rule *Rule) bool { return rule.Owner != nil })
+}
+
+// getOwner renders the OwnerRule of metricName with claims
+func (a *ACL) getOwner(metricName string, claims map[string]interface{}) (*core.Owner, bool) {
+	rule := a.GetRule(metricName).Owner
+	if rule == nil {
+		return nil, false
+	}
+	owner := &core.Owner{
+		Name:          rule.Selector.Name,
+		LabelMatchers: make([]*labels.Matcher, 0, len(rule.Selector.LabelMatchers)),
+		On:            rule.On,
+	}
+	for _, matcher := range rule.Selector.LabelMatchers {
+		rendered, ok := renderMatcher(matcher, claims)
+		if !ok {
+			// unknown claims deny access to all series
+			owner.LabelMatchers = append(owner.LabelMatchers, None...)
+			continue
+		}
+		owner.LabelMatchers = append(owner.LabelMatchers, rendered)
+	}
+	return owner, true
+}
+
+// renderMatcher replaces a claim placeholder in the value of matcher, list claims
+// are converted into a regex matcher
+func renderMatcher(matcher *labels.Matcher, claims map[string]interface{}) (*labels.Matcher, bool) {
+	placeholder := claimPlaceholder.FindStringSubmatch(matcher.Value)
+	if placeholder == nil {
+		return matcher, true
+	}
+	values := []string{}
+	switch claim := claims[placeholder[1]].(type) {
+	case string:
+		values = append(values, claim)
+	case []interface{}:
+		for _, item := range claim {
+			value, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, value)
+		}
+	default:
+		return nil, false
+	}
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	matchType, value := matcher.Type, values[0]
+	if len(values) > 1 || matchType == labels.MatchRegexp || matchType == labels.MatchNotRegexp {
+		for i := range values {
+			values[i] = regexp.QuoteMeta(values[i])
+		}
+		value = strings.Join(values, "|")
+		switch matchType {
+		case labels.MatchEqual:
+			matchType = labels.MatchRegexp
+		case labels.MatchNotEqual:
+			matchType = labels.MatchNotRegexp
+		}
+	}
+	rendered, err := labels.NewMatcher(matchType, matcher.Name, value)
+	if err != nil {
+		return nil, false
+	}
+	return rendered, true
+}
+
+// parseOwner parses the selector of an OwnerRule
+func parseOwner(load *ownerLoad) (*OwnerRule, error) {
+	if len(load.On) == 0 {
+		return nil, fmt.Errorf("owner requires at least one label in on")
+	}
+	expr, err := parser.ParseExpr(load.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse owner selector: %s", err)
+	}
+	selector, ok := expr.(*parser.VectorSelector)
+	if !ok || selector.OriginalOffset != 0 || selector.Timestamp != nil || selector.StartOrEnd != 0 {
+		return nil, fmt.Errorf("owner selector '%s' is not a plain vector selector", load.Selector)
+	}
+	return &OwnerRule{
+		Selector: selector,
+		On:       load.On,
+	}, nil
+}
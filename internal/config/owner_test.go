@@ -0,0 +1,57 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestGetOwner(t *testing.T) {
+	acl := &ACL{Named: NamedACL{}}
+	err := acl.ParseAndStoreACL("container_cpu", map[interface{}]interface{}{
+		"owner": map[interface{}]interface{}{
+			"selector": `kube_namespace_labels{label_team="$team",cluster="a"}`,
+			"on":       []interface{}{"namespace"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to parse acl: %s", err)
+	}
+	if !acl.HasOwners() || acl.HasAggregations() {
+		t.Fatal("expected owner and no aggregation rules")
+	}
+
+	tests := []struct {
+		claims map[string]interface{}
+		output string
+	}{{
+		claims: map[string]interface{}{"team": "payments"},
+		output: `kube_namespace_labels{cluster="a",label_team="payments"}`,
+	}, {
+		claims: map[string]interface{}{"team": `"} or vector(1) or {a="`},
+		output: `kube_namespace_labels{cluster="a",label_team="\"} or vector(1) or {a=\""}`,
+	}, {
+		claims: map[string]interface{}{"team": []interface{}{"payments", "a.b"}},
+		output: `kube_namespace_labels{cluster="a",label_team=~"payments|a\\.b"}`,
+	}, {
+		claims: map[string]interface{}{},
+		output: `kube_namespace_labels{__="none",cluster="a"}`,
+	}, {
+		claims: map[string]interface{}{"team": 5},
+		output: `kube_namespace_labels{__="none",cluster="a"}`,
+	}}
+	for _, test := range tests {
+		owner, ok := acl.WithClaims(test.claims).GetOwner("container_cpu")
+		if !ok {
+			t.Fatalf("owner missing for %v", test.claims)
+		}
+		got := (&parser.VectorSelector{Name: owner.Name, LabelMatchers: owner.LabelMatchers}).String()
+		if got != test.output {
+			t.Fatalf("invalid owner:\nclaims: %v\nwant:   %s\ngot:    %s", test.claims, test.output, got)
+		}
+	}
+
+	if _, ok := acl.GetOwner("other"); ok {
+		t.Fatalf("other must not have an owner")
+	}
+}
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseNetworks parses a list of CIDRs, single addresses are treated as /32 or /128
+func parseNetworks(cidrs []string) (networks []*net.IPNet, err error) {
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("unable to parse trusted proxy %s: invalid address", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse trusted proxy %s: %s", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
@@ -0,0 +1,321 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/bitsbeats/prometheus-acls/internal/labeler"
+)
+
+// DefaultUpstream is the name of the upstream used by roles and rules without an upstream
+const DefaultUpstream = "default"
+
+const (
+	// EnforceAST injects the label matchers into the queries
+	EnforceAST = "ast"
+	// EnforceExtraLabel enforces the label matchers of the wildcard rule with the
+	// extra_label and extra_filters[] parameters of VictoriaMetrics
+	EnforceExtraLabel = "extra_label"
+	// EnforcePromLabelProxy enforces the label matchers of the wildcard rule with the
+	// query parameter of prom-label-proxy
+	EnforcePromLabelProxy = "prom_label_proxy"
+)
+
+// DefaultExternalLabel is the default label that holds the upstream of series of a fanout
+const DefaultExternalLabel = "upstream"
+
+type (
+	// Upstream is a Prometheus server or a pool of replicas requests are proxied to. An
+	// Upstream with Fanout sends queries to all listed upstreams and merges the results
+	Upstream struct {
+		Name                string
+		URLs                []*url.URL
+		HealthCheckInterval time.Duration
+		EjectDuration       time.Duration
+		Fanout              []string
+		ExternalLabel       string
+		BasicAuth           *BasicAuth
+		BearerTokenFile     string
+		TLSConfig           TLSConfig
+		Enforcement         string
+		Label               string
+	}
+
+	// BasicAuth configures the basic auth credentials for an Upstream
+	BasicAuth struct {
+		Username     string `yaml:"username"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"password_file"`
+	}
+
+	// TLSConfig configures the TLS connection to an Upstream
+	TLSConfig struct {
+		CAFile             string `yaml:"ca_file"`
+		CertFile           string `yaml:"cert_file"`
+		KeyFile            string `yaml:"key_file"`
+		ServerName         string `yaml:"server_name"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	}
+
+	// upstreamLoad is the yaml representation of an Upstream
+	upstreamLoad struct {
+		URL                 string         `yaml:"url"`
+		URLs                []string       `yaml:"urls"`
+		HealthCheckInterval model.Duration `yaml:"health_check_interval"`
+		EjectDuration       model.Duration `yaml:"eject_duration"`
+		Fanout              []string       `yaml:"fanout"`
+		ExternalLabel       string         `yaml:"external_label"`
+		BasicAuth           *BasicAuth     `yaml:"basic_auth"`
+		BearerTokenFile     string         `yaml:"bearer_token_file"`
+		TLSConfig           TLSConfig      `yaml:"tls_config"`
+		Enforcement         string         `yaml:"enforcement"`
+		Label               string         `yaml:"label"`
+	}
+
+	// UpstreamMap is used to look up an Upstream by its name
+	UpstreamMap map[string]*Upstream
+)
+
+// parseUpstreams loads the upstreams from file, the DefaultUpstream is created from
+// defaultURL unless it is configured in file
+func parseUpstreams(file string, defaultURL string) (upstreams UpstreamMap, err error) {
+	upstreamMapLoad := map[string]upstreamLoad{}
+	if file != "" {
+		fp, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open upstreams: %s", err)
+		}
+		defer fp.Close()
+		decoder := yaml.NewDecoder(fp)
+		decoder.SetStrict(true)
+		err = decoder.Decode(&upstreamMapLoad)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load upstreams: %s", err)
+		}
+	}
+	if _, ok := upstreamMapLoad[DefaultUpstream]; !ok {
+		upstreamMapLoad[DefaultUpstream] = upstreamLoad{URL: defaultURL}
+	}
+
+	upstreams = UpstreamMap{}
+	for name, load := range upstreamMapLoad {
+		if len(load.Fanout) > 0 {
+			upstreams[name], err = parseFanout(name, load, upstreamMapLoad)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rawURLs := load.URLs
+		if load.URL != "" {
+			rawURLs = append([]string{load.URL}, rawURLs...)
+		}
+		if len(rawURLs) == 0 {
+			return nil, fmt.Errorf("unable to load upstream %s: no url configured", name)
+		}
+		err = checkCredentials(load)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load upstream %s: %s", name, err)
+		}
+		err = checkEnforcement(&load)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load upstream %s: %s", name, err)
+		}
+		upstream := &Upstream{
+			Name:                name,
+			HealthCheckInterval: time.Duration(load.HealthCheckInterval),
+			EjectDuration:       time.Duration(load.EjectDuration),
+			BasicAuth:           load.BasicAuth,
+			BearerTokenFile:     load.BearerTokenFile,
+			TLSConfig:           load.TLSConfig,
+			Enforcement:         load.Enforcement,
+			Label:               load.Label,
+		}
+		for _, rawURL := range rawURLs {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse url of upstream %s: %s", name, err)
+			}
+			if u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("unable to parse url of upstream %s: %q is not absolute", name, rawURL)
+			}
+			upstream.URLs = append(upstream.URLs, u)
+		}
+		upstreams[name] = upstream
+	}
+	return
+}
+
+// parseFanout creates the fanout Upstream name, its members must be upstreams with urls
+func parseFanout(name string, load upstreamLoad, upstreamMapLoad map[string]upstreamLoad) (*Upstream, error) {
+	if load.URL != "" || len(load.URLs) > 0 {
+		return nil, fmt.Errorf("unable to load upstream %s: fanout and urls are exclusive", name)
+	}
+	if load.BasicAuth != nil || load.BearerTokenFile != "" || load.TLSConfig != (TLSConfig{}) {
+		return nil, fmt.Errorf("unable to load upstream %s: credentials are configured on the upstreams of a fanout", name)
+	}
+	if load.Enforcement != "" || load.Label != "" {
+		return nil, fmt.Errorf("unable to load upstream %s: enforcement is configured on the upstreams of a fanout", name)
+	}
+	for _, member := range load.Fanout {
+		memberLoad, ok := upstreamMapLoad[member]
+		if !ok {
+			return nil, fmt.Errorf("unable to find upstream %s of fanout %s", member, name)
+		}
+		if len(memberLoad.Fanout) > 0 {
+			return nil, fmt.Errorf("unable to load upstream %s: fanout %s can not be nested", name, member)
+		}
+	}
+	externalLabel := load.ExternalLabel
+	if externalLabel == "" {
+		externalLabel = DefaultExternalLabel
+	}
+	if !model.LabelName(externalLabel).IsValid() {
+		return nil, fmt.Errorf("unable to load upstream %s: %q is not a valid label", name, externalLabel)
+	}
+	return &Upstream{
+		Name:          name,
+		Fanout:        load.Fanout,
+		ExternalLabel: externalLabel,
+	}, nil
+}
+
+// checkCredentials verifies that the credentials of an upstream are not ambiguous
+func checkCredentials(load upstreamLoad) error {
+	if load.BasicAuth != nil {
+		if load.BearerTokenFile != "" {
+			return fmt.Errorf("basic_auth and bearer_token_file are exclusive")
+		}
+		if load.BasicAuth.Password != "" && load.BasicAuth.PasswordFile != "" {
+			return fmt.Errorf("password and password_file are exclusive")
+		}
+	}
+	if (load.TLSConfig.CertFile == "") != (load.TLSConfig.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be configured together")
+	}
+	return nil
+}
+
+// checkEnforcement verifies the enforcement of an upstream and sets the default
+func checkEnforcement(load *upstreamLoad) error {
+	switch load.Enforcement {
+	case "":
+		load.Enforcement = EnforceAST
+	case EnforceAST, EnforceExtraLabel:
+	case EnforcePromLabelProxy:
+		if !model.LabelName(load.Label).IsValid() {
+			return fmt.Errorf("prom_label_proxy requires a valid label, got %q", load.Label)
+		}
+		return nil
+	default:
+		return fmt.Errorf("enforcement %q is not one of ast, extra_label or prom_label_proxy", load.Enforcement)
+	}
+	if load.Label != "" {
+		return fmt.Errorf("label is only supported by prom_label_proxy")
+	}
+	return nil
+}
+
+// GetUpstream returns the name of the upstream metricName is queried from, an empty
+// metricName returns the upstream of the role
+func (a *ACL) GetUpstream(metricName string) string {
+	if metricName != "" {
+		if upstream := a.GetRule(metricName).Upstream; upstream != "" {
+			return upstream
+		}
+	}
+	if a.Options.Upstream != "" {
+		return a.Options.Upstream
+	}
+	return DefaultUpstream
+}
+
+// checkUpstreams verifies that all upstreams referenced by the ACL exist. Upstreams
+// with native enforcement only enforce the label matchers of the WildcardMetric, so
+// rules and options that require the AST enforcement must not be routed to them
+func (a *ACL) checkUpstreams(upstreams UpstreamMap) error {
+	roleUpstream := a.Options.Upstream
+	if roleUpstream == "" {
+		roleUpstream = DefaultUpstream
+	}
+	native, err := upstreams.native(roleUpstream)
+	if err != nil {
+		return fmt.Errorf("unable to check upstream of role %s: %s", a.Role, err)
+	}
+	anyNative := native != ""
+
+	checkRule := func(metricName string, rule *Rule) error {
+		name := rule.Upstream
+		if name == "" {
+			name = roleUpstream
+		}
+		native, err := upstreams.native(name)
+		if err != nil {
+			return fmt.Errorf("unable to check upstream of rule %s of role %s: %s", metricName, a.Role, err)
+		}
+		if native == "" {
+			return nil
+		}
+		anyNative = true
+		if metricName != labeler.WildcardMetric {
+			return fmt.Errorf("rule %s of role %s is routed to upstream %s with native enforcement, only the rule of '*' is enforced", metricName, a.Role, native)
+		}
+		if len(rule.AggregateBy) > 0 || rule.Owner != nil {
+			return fmt.Errorf("aggregate_by and owner of role %s are not supported by upstream %s with native enforcement", a.Role, native)
+		}
+		return nil
+	}
+	for metricName, rule := range a.Named {
+		err = checkRule(string(metricName), rule)
+		if err != nil {
+			return err
+		}
+	}
+	for _, racl := range a.Regex {
+		err = checkRule("re!"+racl.Regexp.String(), racl.Rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	if anyNative && a.Options.requireAST() {
+		return fmt.Errorf("forbidden_labels, redact, max_lookback, not_before, limits and functions of role %s are not supported by upstreams with native enforcement", a.Role)
+	}
+	return nil
+}
+
+// native returns the name of the upstream with native enforcement name is or fans out
+// to, an empty string if all upstreams use the AST enforcement
+func (u UpstreamMap) native(name string) (string, error) {
+	upstream, ok := u[name]
+	if !ok {
+		return "", fmt.Errorf("unable to find upstream %s", name)
+	}
+	for _, member := range upstream.Fanout {
+		native, err := u.native(member)
+		if err != nil || native != "" {
+			return native, err
+		}
+	}
+	if upstream.Enforcement != EnforceAST && len(upstream.Fanout) == 0 {
+		return name, nil
+	}
+	return "", nil
+}
+
+// requireAST checks if the options are only enforced by the AST enforcement
+func (o *Options) requireAST() bool {
+	return len(o.ForbiddenLabels) > 0 ||
+		len(o.Redact) > 0 ||
+		o.MaxLookback != 0 ||
+		!o.NotBefore.IsZero() ||
+		o.Limits != (Limits{}) ||
+		len(o.Functions.Allow) > 0 ||
+		len(o.Functions.Deny) > 0 ||
+		len(o.Functions.MaxRange) > 0
+}
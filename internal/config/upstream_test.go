@@ -0,0 +1,95 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestCheckUpstreams(t *testing.T) {
+	upstreams := UpstreamMap{
+		DefaultUpstream: {Name: DefaultUpstream, Enforcement: EnforceAST},
+		"vm":            {Name: "vm", Enforcement: EnforceExtraLabel},
+		"proxy":         {Name: "proxy", Enforcement: EnforcePromLabelProxy, Label: "namespace"},
+		"all":           {Name: "all", Enforcement: EnforceAST, Fanout: []string{DefaultUpstream, "vm"}},
+	}
+
+	tests := []struct {
+		name string
+		role string
+		err  string
+	}{{
+		name: "wildcard on native upstream",
+		role: `{__options__: {upstream: vm, rate_limit: {role: {requests_per_second: 1}}}, '*': 'namespace="a"'}`,
+	}, {
+		name: "rules on ast upstream",
+		role: `{__options__: {forbidden_labels: [pod]}, secret_app_: ~, '*': ''}`,
+	}, {
+		name: "denied metric on native upstream",
+		role: `{__options__: {upstream: vm}, secret_app_: ~, '*': ''}`,
+		err:  "rule secret_app_ of role test is routed to upstream vm",
+	}, {
+		name: "denied metric on prom-label-proxy",
+		role: `{__options__: {upstream: proxy}, secret_app_: ~, '*': 'namespace="a"'}`,
+		err:  "rule secret_app_ of role test is routed to upstream proxy",
+	}, {
+		name: "rule routed to native upstream",
+		role: `{up: {labels: 'job="a"', upstream: vm}, '*': ''}`,
+		err:  "rule up of role test is routed to upstream vm",
+	}, {
+		name: "regex rule on native upstream",
+		role: `{__options__: {upstream: vm}, 're!^secret_.*': ~, '*': ''}`,
+		err:  "rule re!^secret_.* of role test is routed to upstream vm",
+	}, {
+		name: "fanout to native upstream",
+		role: `{__options__: {upstream: all}, secret_app_: ~, '*': ''}`,
+		err:  "rule secret_app_ of role test is routed to upstream vm",
+	}, {
+		name: "aggregation on native upstream",
+		role: `{__options__: {upstream: vm}, '*': {aggregate_by: [service]}}`,
+		err:  "aggregate_by and owner of role test are not supported",
+	}, {
+		name: "options on native upstream",
+		role: `{__options__: {upstream: vm, max_lookback: 1d}, '*': ''}`,
+		err:  "of role test are not supported by upstreams with native enforcement",
+	}, {
+		name: "options with wildcard rule on native upstream",
+		role: `{__options__: {forbidden_labels: [pod]}, '*': {labels: '', upstream: vm}}`,
+		err:  "of role test are not supported by upstreams with native enforcement",
+	}, {
+		name: "unknown upstream",
+		role: `{__options__: {upstream: unknown}, '*': ''}`,
+		err:  "unable to find upstream unknown",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			load := map[string]interface{}{}
+			err := yaml.Unmarshal([]byte(test.role), &load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			acl := &ACL{Role: "test", Named: NamedACL{}, Regex: []RegexACL{}}
+			for metricName, query := range load {
+				if metricName == OptionsKey {
+					err = acl.ParseAndStoreOptions(query)
+				} else {
+					err = acl.ParseAndStoreACL(metricName, query)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = acl.checkUpstreams(upstreams)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package config
+
+type (
+	// UserACL is an ACL bound to the claims of a user
+	UserACL struct {
+		*ACL
+		claims map[string]interface{}
+	}
+)
+
+// WithClaims binds the ACL to the claims of a user
+func (a *ACL) WithClaims(claims map[string]interface{}) *UserACL {
+	return &UserACL{
+		ACL:    a,
+		claims: claims,
+	}
+}
+
+// GetRole returns the role of the ACL
+func (u *UserACL) GetRole() string {
+	return string(u.Role)
+}
+
+// GetSubject returns the subject claim of the user
+func (u *UserACL) GetSubject() string {
+	subject, _ := u.claims["sub"].(string)
+	return subject
+}
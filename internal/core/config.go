@@ -1,7 +1,18 @@
 package core
 
 import (
-	"github.com/prometheus/prometheus/pkg/labels"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// RedactDrop removes a label from responses
+	RedactDrop = "drop"
+	// RedactReplace replaces the value of a label with a constant
+	RedactReplace = "replace"
+	// RedactHMAC replaces the value of a label with a keyed HMAC pseudonym
+	RedactHMAC = "hmac"
 )
 
 type (
@@ -10,4 +21,137 @@ type (
 		// GetLabelMatchers returns the LabelMatchers for a metric name
 		GetLabelMatchers(string) []*labels.Matcher
 	}
+
+	// AggregationACL is implemented by ACLs that restrict metrics to aggregated access
+	AggregationACL interface {
+		// GetAggregationLabels returns the labels a metric may be grouped by, ok is false
+		// if the metric is not restricted to aggregations
+		GetAggregationLabels(string) (labels []string, ok bool)
+		// HasAggregations checks if any metric is restricted to aggregations
+		HasAggregations() bool
+	}
+
+	// LabelACL is implemented by ACLs that forbid access to label dimensions
+	LabelACL interface {
+		// GetForbiddenLabels returns the labels that may not be used for grouping or matching
+		GetForbiddenLabels() []string
+	}
+
+	// Owner describes the ownership info metric a metric is joined with
+	Owner struct {
+		// Name and LabelMatchers select the ownership info metric
+		Name          string
+		LabelMatchers []*labels.Matcher
+		// On are the labels shared by the metric and the ownership info metric
+		On []string
+	}
+
+	// OwnerACL is implemented by ACLs that restrict metrics by their ownership
+	OwnerACL interface {
+		// GetOwner returns the Owner of a metric, ok is false if the metric is not
+		// restricted by ownership
+		GetOwner(string) (owner *Owner, ok bool)
+		// HasOwners checks if any metric is restricted by ownership
+		HasOwners() bool
+	}
+
+	// TimeACL is implemented by ACLs that restrict the time range of queries
+	TimeACL interface {
+		// GetTimeRestrictions returns how far queries may look back from now and the
+		// earliest time that may be queried, zero values are unrestricted
+		GetTimeRestrictions() (maxLookback time.Duration, notBefore time.Time)
+	}
+
+	// Limits restricts the cost of queries, zero values are unlimited
+	Limits struct {
+		// MaxRange is the maximum duration between start and end of a range query
+		MaxRange time.Duration
+		// MinStep is the minimum resolution of a range query
+		MinStep time.Duration
+		// MaxSelectors is the maximum number of selectors in a query
+		MaxSelectors int
+		// MaxSubqueryDepth is the maximum nesting of subqueries
+		MaxSubqueryDepth int
+		// MaxPoints is the maximum of the estimated points of a query
+		MaxPoints int64
+	}
+
+	// LimitACL is implemented by ACLs that restrict the cost of queries
+	LimitACL interface {
+		// GetLimits returns the Limits for queries
+		GetLimits() Limits
+	}
+
+	// FunctionPolicy restricts the functions and aggregation operators of queries
+	FunctionPolicy struct {
+		// Allow are the only allowed functions if not empty
+		Allow []string
+		// Deny are the forbidden functions
+		Deny []string
+		// MaxRange limits the range vector argument of functions
+		MaxRange map[string]time.Duration
+	}
+
+	// FunctionACL is implemented by ACLs that restrict the functions of queries
+	FunctionACL interface {
+		// GetFunctionPolicy returns the FunctionPolicy for queries
+		GetFunctionPolicy() FunctionPolicy
+	}
+
+	// IdentityACL is implemented by ACLs that are bound to an authenticated user
+	IdentityACL interface {
+		// GetRole returns the role of the ACL
+		GetRole() string
+		// GetSubject returns the subject of the user
+		GetSubject() string
+	}
+
+	// RateLimit configures a token bucket and the concurrency for requests, zero
+	// values are unlimited
+	RateLimit struct {
+		RequestsPerSecond float64
+		Burst             int
+		MaxInFlight       int
+	}
+
+	// RateLimitACL is implemented by ACLs that throttle requests
+	RateLimitACL interface {
+		// GetRateLimits returns the RateLimit shared by the role and the RateLimit
+		// for each subject
+		GetRateLimits() (role RateLimit, subject RateLimit)
+	}
+
+	// UpstreamACL is implemented by ACLs that route queries to different upstreams
+	UpstreamACL interface {
+		// GetUpstream returns the name of the upstream a metric is queried from, an
+		// empty metric name returns the upstream of the role
+		GetUpstream(string) string
+	}
+
+	// TenantACL is implemented by ACLs that restrict queries to tenants of a multi-tenant
+	// upstream like Cortex, Mimir or Thanos
+	TenantACL interface {
+		// GetTenants returns the tenants that may be queried
+		GetTenants() []string
+	}
+
+	// Redaction describes how the value of a label is hidden in responses
+	Redaction struct {
+		// Action is one of RedactDrop, RedactReplace or RedactHMAC
+		Action string
+		// Replacement is the constant used by RedactReplace
+		Replacement string
+	}
+
+	// RedactionACL is implemented by ACLs that hide label values in responses
+	RedactionACL interface {
+		// GetRedactions returns the Redaction for each redacted label
+		GetRedactions() map[string]Redaction
+	}
+
+	// PseudonymResolver maps pseudonyms back to their label values
+	PseudonymResolver interface {
+		// Resolve returns the value of label that has been replaced by pseudonym
+		Resolve(label string, pseudonym string) (value string, ok bool)
+	}
 )
@@ -0,0 +1,107 @@
+package labeler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// checkAggregation ensures that a selector for a metric that may only be queried
+// aggregated has an ancestor aggregation that groups by the allowed labels only. The
+// selector and the vector matching below the aggregation may only use the allowed
+// labels, otherwise single series could be filtered before they are aggregated
+func checkAggregation(vs *parser.VectorSelector, acl core.ACL, path []parser.Node) error {
+	aggregationACL, ok := acl.(core.AggregationACL)
+	if !ok {
+		return nil
+	}
+	name, _ := metricName(vs)
+	allowed, ok := aggregationACL.GetAggregationLabels(name)
+	if !ok {
+		return nil
+	}
+	for _, matcher := range vs.LabelMatchers {
+		if matcher.Name != labels.MetricName && !contains(allowed, matcher.Name) {
+			return fmt.Errorf(
+				"%w: %s may only be matched by a subset of (%s) before it is aggregated",
+				ErrForbidden, name, strings.Join(allowed, ", "),
+			)
+		}
+	}
+	for i := len(path) - 2; i >= 0; i-- {
+		if binary, ok := path[i].(*parser.BinaryExpr); ok && !isMatchingAllowed(binary, allowed) {
+			return fmt.Errorf(
+				"%w: %s may only be joined on a subset of (%s) without group_left or group_right labels before it is aggregated",
+				ErrForbidden, name, strings.Join(allowed, ", "),
+			)
+		}
+		if call, ok := path[i].(*parser.Call); ok && isRelabeling(call) {
+			// the grouping labels could be replaced with any other label
+			return fmt.Errorf(
+				"%w: %s may not be relabeled with %s before it is aggregated",
+				ErrForbidden, name, call.Func.Name,
+			)
+		}
+		aggregation, ok := path[i].(*parser.AggregateExpr)
+		if !ok || aggregation.Expr != path[i+1] {
+			// parameters of aggregations are not aggregated
+			continue
+		}
+		if isAggregating(aggregation, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"%w: %s may only be queried inside sum, avg, min, max, count, group, stddev, stdvar or quantile by a subset of (%s)",
+		ErrForbidden, name, strings.Join(allowed, ", "),
+	)
+}
+
+// isAggregating checks if the aggregation drops all labels except the allowed ones
+func isAggregating(aggregation *parser.AggregateExpr, allowed []string) bool {
+	switch aggregation.Op {
+	case parser.SUM, parser.AVG, parser.MIN, parser.MAX, parser.COUNT, parser.GROUP,
+		parser.STDDEV, parser.STDVAR, parser.QUANTILE:
+	default:
+		// topk, bottomk, limitk, limit_ratio and count_values keep or expose series
+		return false
+	}
+	if aggregation.Without {
+		return false
+	}
+	for _, label := range aggregation.Grouping {
+		if !contains(allowed, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// isMatchingAllowed checks if a binary expression matches on the allowed labels only.
+// Matching on all labels or with ignoring uses labels that are not allowed and the
+// include labels of group_left and group_right overwrite labels of the series
+func isMatchingAllowed(binary *parser.BinaryExpr, allowed []string) bool {
+	matching := binary.VectorMatching
+	if matching == nil {
+		// scalar operands do not filter series
+		return true
+	}
+	if !matching.On || len(matching.Include) > 0 {
+		return false
+	}
+	for _, label := range matching.MatchingLabels {
+		if !contains(allowed, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// isRelabeling checks if the function writes labels
+func isRelabeling(call *parser.Call) bool {
+	return call.Func.Name == "label_replace" || call.Func.Name == "label_join"
+}
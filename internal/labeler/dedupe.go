@@ -1,7 +1,7 @@
 package labeler
 
 import (
-	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/model/labels"
 )
 
 type labelMatcherDeduper struct {
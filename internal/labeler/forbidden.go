@@ -0,0 +1,137 @@
+package labeler
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// restrictLabels rejects expressions that group or match on forbidden labels and
+// rewrites aggregations using without to drop the forbidden labels as well
+func restrictLabels(expr parser.Expr, acl core.ACL) error {
+	labelACL, ok := acl.(core.LabelACL)
+	if !ok {
+		return nil
+	}
+	forbidden := labelACL.GetForbiddenLabels()
+	if len(forbidden) == 0 {
+		return nil
+	}
+
+	switch casted := expr.(type) {
+	case *parser.AggregateExpr:
+		if casted.Without {
+			for _, label := range forbidden {
+				if !contains(casted.Grouping, label) {
+					casted.Grouping = append(casted.Grouping, label)
+				}
+			}
+		} else if label, ok := containsAny(casted.Grouping, forbidden); ok {
+			return forbiddenLabelError(label, "by(...)")
+		}
+		if casted.Op == parser.COUNT_VALUES {
+			if label, ok := stringArg(casted.Param); ok && contains(forbidden, label) {
+				return forbiddenLabelError(label, "count_values")
+			}
+		}
+	case *parser.BinaryExpr:
+		if casted.VectorMatching == nil {
+			return nil
+		}
+		if casted.VectorMatching.On {
+			if label, ok := containsAny(casted.VectorMatching.MatchingLabels, forbidden); ok {
+				return forbiddenLabelError(label, "on(...)")
+			}
+		}
+		if label, ok := containsAny(casted.VectorMatching.Include, forbidden); ok {
+			return forbiddenLabelError(label, "group_left(...) or group_right(...)")
+		}
+	case *parser.Call:
+		switch casted.Func.Name {
+		case "label_replace", "label_join":
+			// label_replace(v, dst, replacement, src, regex) and
+			// label_join(v, dst, separator, src...) only name labels in dst and src
+			for _, arg := range labelArgs(casted) {
+				if label, ok := stringArg(arg); ok && contains(forbidden, label) {
+					return forbiddenLabelError(label, casted.Func.Name)
+				}
+			}
+		}
+	case *parser.VectorSelector:
+		for _, matcher := range casted.LabelMatchers {
+			if contains(forbidden, matcher.Name) {
+				return forbiddenLabelError(matcher.Name, "label matchers")
+			}
+		}
+	}
+	return nil
+}
+
+// checkLabelValuesPath rejects label values requests for forbidden labels
+func checkLabelValuesPath(path string, acl core.ACL) error {
+	labelACL, ok := acl.(core.LabelACL)
+	if !ok || !strings.HasPrefix(path, "/api/v1/label/") || !strings.HasSuffix(path, "/values") {
+		return nil
+	}
+	label, err := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(path, "/api/v1/label/"), "/values"))
+	if err != nil {
+		return fmt.Errorf("%w: unable to parse label name: %s", ErrBadData, err)
+	}
+	if contains(labelACL.GetForbiddenLabels(), label) {
+		return forbiddenLabelError(label, "label values requests")
+	}
+	return nil
+}
+
+// labelArgs returns the arguments of label_replace and label_join that are label names
+func labelArgs(call *parser.Call) parser.Expressions {
+	if len(call.Args) < 4 {
+		return nil
+	}
+	if call.Func.Name == "label_replace" {
+		return parser.Expressions{call.Args[1], call.Args[3]}
+	}
+	return append(parser.Expressions{call.Args[1]}, call.Args[3:]...)
+}
+
+// forbiddenLabelError creates the error for a forbidden label used in construct
+func forbiddenLabelError(label string, construct string) error {
+	return fmt.Errorf("%w: label %s may not be used in %s", ErrForbidden, label, construct)
+}
+
+// stringArg returns the value of a string literal argument
+func stringArg(expr parser.Expr) (string, bool) {
+	switch casted := expr.(type) {
+	case *parser.StringLiteral:
+		return casted.Val, true
+	case *parser.ParenExpr:
+		return stringArg(casted.Expr)
+	case *parser.StepInvariantExpr:
+		return stringArg(casted.Expr)
+	}
+	return "", false
+}
+
+// contains checks if list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny returns the first item of list that is in search
+func containsAny(list []string, search []string) (string, bool) {
+	for _, item := range list {
+		if contains(search, item) {
+			return item, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,95 @@
+package labeler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// checkFunction rejects functions and aggregation operators that are not allowed by
+// the core.FunctionPolicy of the acl
+func checkFunction(expr parser.Expr, acl core.ACL) error {
+	functionACL, ok := acl.(core.FunctionACL)
+	if !ok {
+		return nil
+	}
+
+	var name string
+	var args parser.Expressions
+	switch casted := expr.(type) {
+	case *parser.Call:
+		name, args = casted.Func.Name, casted.Args
+	case *parser.AggregateExpr:
+		name = casted.Op.String()
+	default:
+		return nil
+	}
+
+	policy := functionACL.GetFunctionPolicy()
+	if contains(policy.Deny, name) || (len(policy.Allow) > 0 && !contains(policy.Allow, name)) {
+		return fmt.Errorf("%w: function %s is not allowed", ErrForbidden, name)
+	}
+	if maxRange, ok := policy.MaxRange[name]; ok {
+		for _, arg := range args {
+			if argRange, ok := rangeArg(arg); ok && argRange > maxRange {
+				return fmt.Errorf("%w: function %s is limited to a range of %s, got %s",
+					ErrForbidden, name, model.Duration(maxRange), model.Duration(argRange))
+			}
+		}
+	}
+	switch name {
+	case "absent", "absent_over_time":
+		// absent reveals if series of a denied metric exist
+		for _, arg := range args {
+			if metricName, ok := selectorArg(arg); ok && isDenied(acl.GetLabelMatchers(metricName)) {
+				return fmt.Errorf("%w: function %s is not allowed for %s", ErrForbidden, name, metricName)
+			}
+		}
+	}
+	return nil
+}
+
+// rangeArg returns the range of a range vector argument
+func rangeArg(expr parser.Expr) (time.Duration, bool) {
+	switch casted := expr.(type) {
+	case *parser.MatrixSelector:
+		return casted.Range, true
+	case *parser.SubqueryExpr:
+		return casted.Range, true
+	case *parser.ParenExpr:
+		return rangeArg(casted.Expr)
+	case *parser.StepInvariantExpr:
+		return rangeArg(casted.Expr)
+	}
+	return 0, false
+}
+
+// selectorArg returns the metric name of a selector argument
+func selectorArg(expr parser.Expr) (string, bool) {
+	switch casted := expr.(type) {
+	case *parser.VectorSelector:
+		return metricName(casted)
+	case *parser.MatrixSelector:
+		return selectorArg(casted.VectorSelector)
+	case *parser.ParenExpr:
+		return selectorArg(casted.Expr)
+	case *parser.StepInvariantExpr:
+		return selectorArg(casted.Expr)
+	}
+	return "", false
+}
+
+// isDenied checks if the LabelMatchers deny access to all series
+func isDenied(matchers []*labels.Matcher) bool {
+	for _, matcher := range matchers {
+		if matcher.Name == NoneLabelMatcher[0].Name && matcher.Value == NoneLabelMatcher[0].Value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,12 @@
 package labeler
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/prometheus/pkg/labels"
-	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/bitsbeats/prometheus-acls/internal/core"
 )
@@ -16,10 +17,21 @@ type (
 		labelerDurationHist prometheus.Histogram
 		dedupeDurationHist  prometheus.Histogram
 		queryParseHist      prometheus.Histogram
-		promProxyHist       prometheus.Histogram
+		promProxyHist       *prometheus.HistogramVec
+
+		pseudonyms core.PseudonymResolver
 	}
 )
 
+// ErrForbidden is wrapped by all errors caused by queries that violate an ACL
+var ErrForbidden = errors.New("forbidden by acl")
+
+// ErrLimit is wrapped by all errors caused by queries that exceed the limits of an ACL
+var ErrLimit = errors.New("limit exceeded")
+
+// ErrBadData is wrapped by all errors caused by invalid queries or parameters
+var ErrBadData = errors.New("bad data")
+
 // NoneLabelMatcher is a prometheus label matcher that fails for all metrics
 var NoneLabelMatcher = []*labels.Matcher{{
 	Name:  "__",
@@ -30,11 +42,11 @@ var NoneLabelMatcher = []*labels.Matcher{{
 // ParseLabels uses Prometheus promql library to parse a string of Prometheus labels
 // into LaberMatchers
 func ParseLabels(query string) (labelMatchers []*labels.Matcher, err error) {
-	expr, err := promql.ParseExpr(fmt.Sprintf("{%s}", query))
+	expr, err := parser.ParseExpr(fmt.Sprintf("{%s}", query))
 	if err != nil {
 		return nil, err
 	}
-	casted, ok := expr.(*promql.VectorSelector)
+	casted, ok := expr.(*parser.VectorSelector)
 	if !ok {
 		return nil, fmt.Errorf("unable to load labels from '%s'", query)
 	}
@@ -68,55 +80,168 @@ func NewLabeler() (l *Labeler) {
 			Help:    "A Histogram which tracks the time taken to parse Prometheus queries.",
 			Buckets: prometheus.ExponentialBuckets(0.001, 2, 11),
 		}),
-		promProxyHist: prometheus.NewHistogram(prometheus.HistogramOpts{
+		promProxyHist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "prometheus_acls_reverseproxy_response_seconds",
 			Help:    "A Histogram that tracks the response latency of the upstream Prometheus",
 			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
-		}),
+		}, []string{"upstream"}),
 	}
 	prometheus.MustRegister(l.labelerDurationHist, l.queryParseHist, l.promProxyHist)
 	return
 }
 
-// AddLabels reversively walks through a promql.Expr and adds the LabelMatches provided by
-// core.ACL to every metric
+// AddLabels reversively walks through a parser.Expr and adds the LabelMatches provided by
+// core.ACL to every metric. Queries that violate the ACL are rejected with an error
+// wrapping ErrForbidden
 //
 // This function tries to follow the same flow as Promtheus eval
-// https://github.com/prometheus/prometheus/blob/master/promql/engine.go#L923
-func (l *Labeler) AddLabels(expr promql.Expr, acl core.ACL) (labeled promql.Expr) {
+// https://github.com/prometheus/prometheus/blob/main/promql/engine.go
+func (l *Labeler) AddLabels(expr parser.Expr, acl core.ACL) (labeled parser.Expr, err error) {
+	return l.addLabels(expr, acl, nil)
+}
+
+// addLabels is the recursive implementation of AddLabels, path holds the ancestors
+// of expr starting at the root of the query
+func (l *Labeler) addLabels(expr parser.Expr, acl core.ACL, path []parser.Node) (labeled parser.Expr, err error) {
+	path = append(path, expr)
+	err = restrictLabels(expr, acl)
+	if err != nil {
+		return nil, err
+	}
+	err = l.resolveRedactions(expr, acl)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFunction(expr, acl)
+	if err != nil {
+		return nil, err
+	}
 	switch casted := expr.(type) {
-	case *promql.AggregateExpr:
-		casted.Expr = l.AddLabels(casted.Expr, acl)
-		return casted
-	case *promql.Call:
+	case *parser.AggregateExpr:
+		if casted.Param != nil {
+			casted.Param, err = l.addLabels(casted.Param, acl, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		casted.Expr, err = l.addLabels(casted.Expr, acl, path)
+		return casted, err
+	case *parser.Call:
 		for i, expr := range casted.Args {
-			casted.Args[i] = l.AddLabels(expr, acl)
+			casted.Args[i], err = l.addLabels(expr, acl, path)
+			if err != nil {
+				return nil, err
+			}
 		}
-		return casted
-	case *promql.ParenExpr:
-		casted.Expr = l.AddLabels(casted.Expr, acl)
-		return casted
-	case *promql.UnaryExpr:
-		casted.Expr = l.AddLabels(casted.Expr, acl)
-		return casted
-	case *promql.BinaryExpr:
-		casted.RHS = l.AddLabels(casted.RHS, acl)
-		casted.LHS = l.AddLabels(casted.LHS, acl)
-		return casted
-	case *promql.NumberLiteral:
-		return expr
-	case *promql.VectorSelector:
-		matchers := append(casted.LabelMatchers, acl.GetLabelMatchers(casted.Name)...)
-		casted.LabelMatchers = DedupeMatchers(matchers)
-		return casted
-	case *promql.MatrixSelector:
-		matchers := append(casted.LabelMatchers, acl.GetLabelMatchers(casted.Name)...)
+		return casted, nil
+	case *parser.ParenExpr:
+		casted.Expr, err = l.addLabels(casted.Expr, acl, path)
+		return casted, err
+	case *parser.UnaryExpr:
+		casted.Expr, err = l.addLabels(casted.Expr, acl, path)
+		return casted, err
+	case *parser.BinaryExpr:
+		casted.RHS, err = l.addLabels(casted.RHS, acl, path)
+		if err != nil {
+			return nil, err
+		}
+		casted.LHS, err = l.addLabels(casted.LHS, acl, path)
+		return casted, err
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return expr, nil
+	case *parser.VectorSelector:
+		var name string
+		name, err = checkMetricName(casted, acl)
+		if err != nil {
+			return nil, err
+		}
+		err = checkAggregation(casted, acl, path)
+		if err != nil {
+			return nil, err
+		}
+		err = checkTimeRange(path, acl)
+		if err != nil {
+			return nil, err
+		}
+		matchers := append(casted.LabelMatchers, acl.GetLabelMatchers(name)...)
 		casted.LabelMatchers = DedupeMatchers(matchers)
-		return casted
-	case *promql.SubqueryExpr:
-		casted.Expr = l.AddLabels(casted.Expr, acl)
-		return casted
+		if _, ok := parent(path).(*parser.MatrixSelector); ok {
+			// range vectors are joined by the MatrixSelector
+			return casted, nil
+		}
+		return joinOwner(casted, acl), nil
+	case *parser.MatrixSelector:
+		err = checkTimeRange(path, acl)
+		if err != nil {
+			return nil, err
+		}
+		casted.VectorSelector, err = l.addLabels(casted.VectorSelector, acl, path)
+		if err != nil {
+			return nil, err
+		}
+		return joinOwnerRange(casted, acl), nil
+	case *parser.SubqueryExpr:
+		casted.Expr, err = l.addLabels(casted.Expr, acl, path)
+		return casted, err
+	case *parser.StepInvariantExpr:
+		casted.Expr, err = l.addLabels(casted.Expr, acl, path)
+		return casted, err
 	}
-	return expr
+	return expr, nil
 }
 
+// MetricNames returns the names of all metrics selected by query
+func MetricNames(query string) (names []string, err error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			name, _ := metricName(vs)
+			names = append(names, name)
+		}
+		return nil
+	})
+	return
+}
+
+// metricName returns the metric name of vs, either its name or the value of an
+// equality matcher on __name__. ok is false if the selector may match any other metric
+func metricName(vs *parser.VectorSelector) (name string, ok bool) {
+	if vs.Name != "" {
+		return vs.Name, true
+	}
+	for _, matcher := range vs.LabelMatchers {
+		if matcher.Name == labels.MetricName && matcher.Type == labels.MatchEqual {
+			return matcher.Value, true
+		}
+	}
+	return "", false
+}
+
+// checkMetricName returns the metric name of vs. Selectors without a metric name
+// would bypass the rules of the metrics they match, they are rejected if the acl has
+// owner or aggregation rules
+func checkMetricName(vs *parser.VectorSelector, acl core.ACL) (string, error) {
+	name, ok := metricName(vs)
+	if ok {
+		return name, nil
+	}
+	aggregationACL, ok := acl.(core.AggregationACL)
+	restricted := ok && aggregationACL.HasAggregations()
+	ownerACL, ok := acl.(core.OwnerACL)
+	restricted = restricted || ok && ownerACL.HasOwners()
+	if restricted {
+		return "", fmt.Errorf("%w: selector %s must match a single metric name", ErrForbidden, vs)
+	}
+	return "", nil
+}
+
+// parent returns the parent of the last node in path
+func parent(path []parser.Node) parser.Node {
+	if len(path) < 2 {
+		return nil
+	}
+	return path[len(path)-2]
+}
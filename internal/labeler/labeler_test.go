@@ -1,10 +1,21 @@
 package labeler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/prometheus/prometheus/pkg/labels"
-	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
 )
 
 var l = NewLabeler()
@@ -22,6 +33,113 @@ func (am aclMockNone) GetLabelMatchers(string) []*labels.Matcher {
 	return []*labels.Matcher{}
 }
 
+type aclMockAggregated struct {
+	aclMockAwesome
+}
+
+func (am aclMockAggregated) GetAggregationLabels(metricName string) ([]string, bool) {
+	if metricName == "secret" {
+		return []string{"service", "env"}, true
+	}
+	return nil, false
+}
+
+func (am aclMockAggregated) HasAggregations() bool {
+	return true
+}
+
+type aclMockForbidden struct {
+	aclMockAwesome
+}
+
+func (am aclMockForbidden) GetForbiddenLabels() []string {
+	return []string{"customer_id", "user_email"}
+}
+
+type aclMockRedacted struct {
+	aclMockAwesome
+}
+
+func (am aclMockRedacted) GetRedactions() map[string]core.Redaction {
+	return map[string]core.Redaction{
+		"client_ip": {Action: core.RedactHMAC},
+		"user":      {Action: core.RedactReplace, Replacement: "redacted"},
+	}
+}
+
+type pseudonymMock map[string]string
+
+func (pm pseudonymMock) Resolve(label string, pseudonym string) (string, bool) {
+	value, ok := pm[label+"/"+pseudonym]
+	return value, ok
+}
+
+type aclMockOwner struct {
+	aclMockAwesome
+}
+
+func (am aclMockOwner) GetOwner(metricName string) (*core.Owner, bool) {
+	if metricName != "container_cpu" {
+		return nil, false
+	}
+	return &core.Owner{
+		Name:          "kube_namespace_labels",
+		LabelMatchers: MustParseLabels(`label_team="payments"`),
+		On:            []string{"namespace"},
+	}, true
+}
+
+func (am aclMockOwner) HasOwners() bool {
+	return true
+}
+
+type aclMockTime struct {
+	aclMockAwesome
+	notBefore time.Time
+}
+
+func (am aclMockTime) GetTimeRestrictions() (time.Duration, time.Time) {
+	return 7 * 24 * time.Hour, am.notBefore
+}
+
+type aclMockLimits struct {
+	aclMockAwesome
+}
+
+func (am aclMockLimits) GetLimits() core.Limits {
+	return core.Limits{
+		MaxRange:         30 * 24 * time.Hour,
+		MinStep:          time.Minute,
+		MaxSelectors:     3,
+		MaxSubqueryDepth: 1,
+		MaxPoints:        50000,
+	}
+}
+
+type aclMockFunctions struct{}
+
+func (am aclMockFunctions) GetLabelMatchers(metricName string) []*labels.Matcher {
+	if metricName == "secret" {
+		return NoneLabelMatcher
+	}
+	return aclMockAwesome{}.GetLabelMatchers(metricName)
+}
+
+func (am aclMockFunctions) GetFunctionPolicy() core.FunctionPolicy {
+	return core.FunctionPolicy{
+		Deny:     []string{"label_replace", "count_values", "holt_winters"},
+		MaxRange: map[string]time.Duration{"quantile_over_time": time.Hour},
+	}
+}
+
+type aclMockAllowedFunctions struct {
+	aclMockAwesome
+}
+
+func (am aclMockAllowedFunctions) GetFunctionPolicy() core.FunctionPolicy {
+	return core.FunctionPolicy{Allow: []string{"sum", "rate"}}
+}
+
 func TestParser(t *testing.T) {
 	tests := []struct {
 		input  string
@@ -217,43 +335,43 @@ func TestParser(t *testing.T) {
 		output: "foo{app=\"awesome\"} and bar{app=\"awesome\"} unless baz{app=\"awesome\"} or qux{app=\"awesome\"}",
 		input:  "foo and bar unless baz or qux",
 	}, {
-		output: "bar{app=\"awesome\"} + on(foo) bla{app=\"awesome\"} / on(baz, buz) group_right(test) blub{app=\"awesome\"}",
+		output: "bar{app=\"awesome\"} + on (foo) bla{app=\"awesome\"} / on (baz, buz) group_right (test) blub{app=\"awesome\"}",
 		input:  "bar + on(foo) bla / on(baz, buz) group_right(test) blub",
 	}, {
-		output: "foo{app=\"awesome\"} * on(test, blub) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} * on (test, blub) bar{app=\"awesome\"}",
 		input:  "foo * on(test,blub) bar",
 	}, {
 		input:  "foo * on(test,blub) group_left bar",
-		output: "foo{app=\"awesome\"} * on(test, blub) group_left() bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} * on (test, blub) group_left () bar{app=\"awesome\"}",
 	}, {
-		output: "foo{app=\"awesome\"} and on(test, blub) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} and on (test, blub) bar{app=\"awesome\"}",
 		input:  "foo and on(test,blub) bar",
 	}, {
-		output: "foo{app=\"awesome\"} and on() bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} and on () bar{app=\"awesome\"}",
 		input:  "foo and on() bar",
 	}, {
-		output: "foo{app=\"awesome\"} and ignoring(test, blub) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} and ignoring (test, blub) bar{app=\"awesome\"}",
 		input:  "foo and ignoring(test,blub) bar",
 	}, {
 		input:  "foo and ignoring() bar",
 		output: "foo{app=\"awesome\"} and bar{app=\"awesome\"}",
 	}, {
-		output: "foo{app=\"awesome\"} unless on(bar) baz{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} unless on (bar) baz{app=\"awesome\"}",
 		input:  "foo unless on(bar) baz",
 	}, {
-		output: "foo{app=\"awesome\"} / on(test, blub) group_left(bar) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} / on (test, blub) group_left (bar) bar{app=\"awesome\"}",
 		input:  "foo / on(test,blub) group_left(bar) bar",
 	}, {
-		output: "foo{app=\"awesome\"} / ignoring(test, blub) group_left(blub) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} / ignoring (test, blub) group_left (blub) bar{app=\"awesome\"}",
 		input:  "foo / ignoring(test,blub) group_left(blub) bar",
 	}, {
-		output: "foo{app=\"awesome\"} / ignoring(test, blub) group_left(bar) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} / ignoring (test, blub) group_left (bar) bar{app=\"awesome\"}",
 		input:  "foo / ignoring(test,blub) group_left(bar) bar",
 	}, {
-		output: "foo{app=\"awesome\"} - on(test, blub) group_right(bar, foo) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} - on (test, blub) group_right (bar, foo) bar{app=\"awesome\"}",
 		input:  "foo - on(test,blub) group_right(bar,foo) bar",
 	}, {
-		output: "foo{app=\"awesome\"} - ignoring(test, blub) group_right(bar, foo) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} - ignoring (test, blub) group_right (bar, foo) bar{app=\"awesome\"}",
 		input:  "foo - ignoring(test,blub) group_right(bar,foo) bar",
 	}, {
 		output: "foo{app=\"awesome\"} and 1",
@@ -281,35 +399,35 @@ func TestParser(t *testing.T) {
 		fail:   true,
 	}, {
 		input:  "1 or on(bar) foo",
-		output: "1 or on(bar) foo{app=\"awesome\"}",
+		output: "1 or on (bar) foo{app=\"awesome\"}",
 		fail:   true,
 	}, {
 		input:  "foo == on(bar) 10",
-		output: "foo{app=\"awesome\"} == on(bar) 10",
+		output: "foo{app=\"awesome\"} == on (bar) 10",
 		fail:   true,
 	}, {
 		input:  "foo and on(bar) group_left(baz) bar",
-		output: "foo{app=\"awesome\"} and on(bar) group_left(baz) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} and on (bar) group_left (baz) bar{app=\"awesome\"}",
 		fail:   true,
 	}, {
-		output: "foo{app=\"awesome\"} and on(bar) group_right(baz) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} and on (bar) group_right (baz) bar{app=\"awesome\"}",
 		input:  "foo and on(bar) group_right(baz) bar",
 		fail:   true,
 	}, {
-		output: "foo{app=\"awesome\"} or on(bar) group_left(baz) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} or on (bar) group_left (baz) bar{app=\"awesome\"}",
 		input:  "foo or on(bar) group_left(baz) bar",
 		fail:   true,
 	}, {
-		output: "foo{app=\"awesome\"} or on(bar) group_right(baz) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} or on (bar) group_right (baz) bar{app=\"awesome\"}",
 		input:  "foo or on(bar) group_right(baz) bar",
 		fail:   true,
 	}, {
 		input:  "foo unless on(bar) group_left(baz) bar",
-		output: "foo{app=\"awesome\"} unless on(bar) group_left(baz) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} unless on (bar) group_left (baz) bar{app=\"awesome\"}",
 		fail:   true,
 	}, {
 		input:  "foo unless on(bar) group_right(baz) bar",
-		output: "foo{app=\"awesome\"} unless on(bar) group_right(baz) bar{app=\"awesome\"}",
+		output: "foo{app=\"awesome\"} unless on (bar) group_right (baz) bar{app=\"awesome\"}",
 		fail:   true,
 	}, {
 		input: `http_request}, {group="production"} + on(instance) group_left(job,instance) cpu_count{type="smp"}`,
@@ -414,11 +532,11 @@ func TestParser(t *testing.T) {
 		input: `foo[0m]`,
 		fail:  true,
 	}, {
-		input: `foo[5m30s]`,
-		fail:  true,
+		input:  `foo[5m30s]`,
+		output: "foo{app=\"awesome\"}[5m30s]",
 	}, {
-		input: `foo[5m] OFFSET 1h30m`,
-		fail:  true,
+		input:  `foo[5m] OFFSET 1h30m`,
+		output: "foo{app=\"awesome\"}[5m] offset 1h30m",
 	}, {
 		input: `foo["5m"]`,
 		fail:  true,
@@ -426,11 +544,11 @@ func TestParser(t *testing.T) {
 		input: `foo[]`,
 		fail:  true,
 	}, {
-		input: `foo[1]`,
-		fail:  true,
+		input:  `foo[1]`,
+		output: "foo{app=\"awesome\"}[1s]",
 	}, {
-		input: `some_metric[5m] OFFSET 1`,
-		fail:  true,
+		input:  `some_metric[5m] OFFSET 1`,
+		output: "some_metric{app=\"awesome\"}[5m] offset 1s",
 	}, {
 		input: `some_metric[5m] OFFSET 1mm`,
 		fail:  true,
@@ -444,25 +562,25 @@ func TestParser(t *testing.T) {
 		input: `(foo + bar)[5m]`,
 		fail:  true,
 	}, {
-		output: "sum by(foo) (some_metric{app=\"awesome\"})",
+		output: "sum by (foo) (some_metric{app=\"awesome\"})",
 		input:  "sum by (foo)(some_metric)",
 	}, {
-		output: "avg by(foo) (some_metric{app=\"awesome\"})",
+		output: "avg by (foo) (some_metric{app=\"awesome\"})",
 		input:  "avg by (foo)(some_metric)",
 	}, {
-		output: "max by(foo) (some_metric{app=\"awesome\"})",
+		output: "max by (foo) (some_metric{app=\"awesome\"})",
 		input:  "max by (foo)(some_metric)",
 	}, {
-		output: "sum without(foo) (some_metric{app=\"awesome\"})",
+		output: "sum without (foo) (some_metric{app=\"awesome\"})",
 		input:  "sum without (foo) (some_metric)",
 	}, {
-		output: "sum without(foo) (some_metric{app=\"awesome\"})",
+		output: "sum without (foo) (some_metric{app=\"awesome\"})",
 		input:  "sum (some_metric) without (foo)",
 	}, {
 		output: "stddev(some_metric{app=\"awesome\"})",
 		input:  "stddev(some_metric)",
 	}, {
-		output: "stdvar by(foo) (some_metric{app=\"awesome\"})",
+		output: "stdvar by (foo) (some_metric{app=\"awesome\"})",
 		input:  "stdvar by (foo)(some_metric)",
 	}, {
 		output: "sum(some_metric{app=\"awesome\"})",
@@ -474,7 +592,7 @@ func TestParser(t *testing.T) {
 		output: "count_values(\"value\", some_metric{app=\"awesome\"})",
 		input:  "count_values(\"value\", some_metric)",
 	}, {
-		output: "sum without(and, by, avg, count, alert, annotations) (some_metric{app=\"awesome\"})",
+		output: "sum without (and, by, avg, count, alert, annotations) (some_metric{app=\"awesome\"})",
 		input:  "sum without(and, by, avg, count, alert, annotations)(some_metric)",
 	}, {
 		input: "sum without(==)(some_metric)",
@@ -604,10 +722,10 @@ func TestParser(t *testing.T) {
 		output: "min_over_time(rate(foo{app=\"awesome\",bar=\"baz\"}[2s])[5m:])[4m:3s]",
 		input:  `min_over_time(rate(foo{bar="baz"}[2s])[5m:])[4m:3s]`,
 	}, {
-		output: "min_over_time(rate(foo{app=\"awesome\",bar=\"baz\"}[2s])[5m:])[4m:3s]",
+		output: "min_over_time(rate(foo{app=\"awesome\",bar=\"baz\"}[2s])[5m:] offset 4m)[4m:3s]",
 		input:  `min_over_time(rate(foo{bar="baz"}[2s])[5m:] offset 4m)[4m:3s]`,
 	}, {
-		output: "sum without(and, by, avg, count, alert, annotations) (some_metric{app=\"awesome\"})[30m:10s]",
+		output: "sum without (and, by, avg, count, alert, annotations) (some_metric{app=\"awesome\"})[30m:10s]",
 		input:  "sum without(and, by, avg, count, alert, annotations)(some_metric) [30m:10s]",
 	}, {
 		output: "some_metric{app=\"awesome\"} offset 1m[10m:5s]",
@@ -617,7 +735,7 @@ func TestParser(t *testing.T) {
 		output: "(foo{app=\"awesome\"} + bar{app=\"awesome\",nm=\"val\"})[5m:]",
 	}, {
 		input:  `(foo + bar{nm="val"})[5m:] offset 10m`,
-		output: `(foo{app="awesome"} + bar{app="awesome",nm="val"})[5m:]`,
+		output: `(foo{app="awesome"} + bar{app="awesome",nm="val"})[5m:] offset 10m`,
 	}, {
 		input:  "test[5d] OFFSET 10s [10m:5s]",
 		output: "test{app=\"awesome\"}[5d] offset 10s[10m:5s]",
@@ -625,22 +743,833 @@ func TestParser(t *testing.T) {
 	}, {
 		input: `(foo + bar{nm="val"})[5m:][10m:5s]`,
 		fail:  true,
+	}, {
+		input:  `foo @ 1603774568`,
+		output: `foo{app="awesome"} @ 1603774568.000`,
+	}, {
+		input:  `foo @ start()`,
+		output: `foo{app="awesome"} @ start()`,
+	}, {
+		input:  `foo[5m] @ end() offset -1h`,
+		output: `foo{app="awesome"}[5m] @ end() offset -1h`,
+	}, {
+		input:  `foo offset -5m`,
+		output: `foo{app="awesome"} offset -5m`,
+	}, {
+		input:  `rate(foo[5m] @ 100)[10m:1m] @ 200`,
+		output: `rate(foo{app="awesome"}[5m] @ 100.000)[10m:1m] @ 200.000`,
+	}, {
+		input:  `sum(rate(foo[1m]))[10m:] @ end() offset 5m`,
+		output: `sum(rate(foo{app="awesome"}[1m]))[10m:] @ end() offset 5m`,
+	}, {
+		input:  `{__name__="foo"}`,
+		output: `{__name__="foo",app="awesome"}`,
+	}, {
+		input:  `topk(scalar(bar), foo)`,
+		output: `topk(scalar(bar{app="awesome"}), foo{app="awesome"})`,
+	}, {
+		input:  `quantile(scalar(bar), foo)`,
+		output: `quantile(scalar(bar{app="awesome"}), foo{app="awesome"})`,
+	}, {
+		input:  `group by (job) (foo)`,
+		output: `group by (job) (foo{app="awesome"})`,
+	}, {
+		input:  `present_over_time(foo[5m])`,
+		output: `present_over_time(foo{app="awesome"}[5m])`,
+	}, {
+		input:  `last_over_time(foo[5m] @ start())`,
+		output: `last_over_time(foo{app="awesome"}[5m] @ start())`,
+	}, {
+		input:  `sgn(clamp(foo, 0, 1))`,
+		output: `sgn(clamp(foo{app="awesome"}, 0, 1))`,
+	}, {
+		input:  `histogram_quantile(0.9, sum by (le) (rate(foo_bucket[5m])))`,
+		output: `histogram_quantile(0.9, sum by (le) (rate(foo_bucket{app="awesome"}[5m])))`,
+	}, {
+		input:  `sort_desc(foo) and on (job) absent_over_time(bar[1h])`,
+		output: `sort_desc(foo{app="awesome"}) and on (job) absent_over_time(bar{app="awesome"}[1h])`,
+	}, {
+		input: `foo @ 1 @ 2`,
+		fail:  true,
+	}, {
+		input: `foo @ sum(bar)`,
+		fail:  true,
+	}}
+	for _, test := range tests {
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			if !test.fail {
+				t.Fatalf("should not fail: %s: %s", test.input, err)
+			}
+			continue
+		}
+		if test.fail {
+			t.Fatalf("should fail: %s", test.input)
+		}
+		labeled, err := l.AddLabels(parsed, aclMockAwesome{})
+		if err != nil {
+			t.Fatalf("unable to add labels: %s: %s", test.input, err)
+		}
+		if test.output != labeled.String() {
+			t.Fatalf(
+				"invalid return:\nin:  %s\nwant: %s\ngot:  %s",
+				test.input,
+				test.output,
+				labeled.String(),
+			)
+		}
+	}
+}
+
+func TestStepInvariant(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{{
+		input:  `foo @ 100`,
+		output: `foo{app="awesome"} @ 100.000`,
+	}, {
+		input:  `rate(foo[5m] @ start())`,
+		output: `rate(foo{app="awesome"}[5m] @ start())`,
+	}, {
+		input:  `sum(bar)[10m:1m] @ end()`,
+		output: `sum(bar{app="awesome"})[10m:1m] @ end()`,
+	}}
+	for _, test := range tests {
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		// the engine wraps step invariant expressions before evaluation
+		labeled, err := l.AddLabels(&parser.StepInvariantExpr{Expr: parsed}, aclMockAwesome{})
+		if err != nil {
+			t.Fatalf("unable to add labels: %s: %s", test.input, err)
+		}
+		if _, ok := labeled.(*parser.StepInvariantExpr); !ok {
+			t.Fatalf("invalid type: %T is not a *parser.StepInvariantExpr", labeled)
+		}
+		if got := labeled.String(); got != test.output {
+			t.Fatalf("invalid return:\nin:  %s\nwant: %s\ngot:  %s",
+				test.input,
+				test.output,
+				got,
+			)
+		}
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+		fail   bool
+	}{{
+		input:  `sum(secret)`,
+		output: `sum(secret{app="awesome"})`,
+	}, {
+		input:  `sum by (service) (rate(secret[5m]))`,
+		output: `sum by (service) (rate(secret{app="awesome"}[5m]))`,
+	}, {
+		input:  `max by (env) (sum by (service, env, instance) (secret))`,
+		output: `max by (env) (sum by (service, env, instance) (secret{app="awesome"}))`,
+	}, {
+		input:  `quantile by (env) (0.9, secret)`,
+		output: `quantile by (env) (0.9, secret{app="awesome"})`,
+	}, {
+		input:  `sum by (service) (secret) / on (service) group_left () other`,
+		output: `sum by (service) (secret{app="awesome"}) / on (service) group_left () other{app="awesome"}`,
+	}, {
+		input:  `max_over_time(avg by (service) (secret)[1h:])`,
+		output: `max_over_time(avg by (service) (secret{app="awesome"})[1h:])`,
+	}, {
+		input:  `other`,
+		output: `other{app="awesome"}`,
+	}, {
+		input: `secret`,
+		fail:  true,
+	}, {
+		input: `rate(secret[5m])`,
+		fail:  true,
+	}, {
+		input: `sum by (instance) (secret)`,
+		fail:  true,
+	}, {
+		input: `sum without (instance) (secret)`,
+		fail:  true,
+	}, {
+		input: `topk by (service) (1, secret)`,
+		fail:  true,
+	}, {
+		input: `count_values("value", secret)`,
+		fail:  true,
+	}, {
+		input: `quantile(scalar(secret), other)`,
+		fail:  true,
+	}, {
+		input: `sum(secret) + secret`,
+		fail:  true,
+	}, {
+		input: `sum by (service) (label_replace(secret, "service", "$1", "instance", "(.*)"))`,
+		fail:  true,
+	}, {
+		input: `count by (service) (label_join(secret, "service", ",", "instance", "pod"))`,
+		fail:  true,
+	}, {
+		input: `sum by (env) (label_replace(sum by (service, instance) (secret), "env", "$1", "instance", "(.*)"))`,
+		fail:  true,
+	}, {
+		input: `sum by (service) (secret{instance="host-1:9100"})`,
+		fail:  true,
+	}, {
+		input: `sum by (service) (secret{instance=~"host-1.*"})`,
+		fail:  true,
+	}, {
+		input:  `sum by (service) (secret{env="prod"})`,
+		output: `sum by (service) (secret{app="awesome",env="prod"})`,
+	}, {
+		input: `sum by (service) (secret == on (instance) topk(1, up{instance="a"}))`,
+		fail:  true,
+	}, {
+		input: `sum by (service) (secret * on (instance) group_left (service) label_replace(up, "service", "$1", "instance", "(.*)"))`,
+		fail:  true,
+	}, {
+		input: `sum by (service) (secret * on (env) group_left (service) other)`,
+		fail:  true,
+	}, {
+		input: `sum by (service) (secret * ignoring (instance) other)`,
+		fail:  true,
+	}, {
+		input: `sum by (service) (secret and other{instance="a"})`,
+		fail:  true,
+	}, {
+		input:  `sum by (service) (secret * on (service, env) group_left () other)`,
+		output: `sum by (service) (secret{app="awesome"} * on (service, env) group_left () other{app="awesome"})`,
+	}, {
+		input:  `sum by (service) (secret * 2)`,
+		output: `sum by (service) (secret{app="awesome"} * 2)`,
+	}, {
+		input: `{__name__="secret"}`,
+		fail:  true,
+	}, {
+		input: `sum by (instance) ({__name__=~"secret|other"})`,
+		fail:  true,
+	}, {
+		input: `sum by (instance) ({service="api"})`,
+		fail:  true,
+	}, {
+		input:  `sum by (service) ({__name__="secret"})`,
+		output: `sum by (service) ({__name__="secret",app="awesome"})`,
+	}, {
+		input:  `label_replace(sum by (service) (secret), "svc", "$1", "service", "(.*)")`,
+		output: `label_replace(sum by (service) (secret{app="awesome"}), "svc", "$1", "service", "(.*)")`,
+	}}
+	for _, test := range tests {
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		labeled, err := l.AddLabels(parsed, aclMockAggregated{})
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("should be forbidden: %s: %v", test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		if got := labeled.String(); got != test.output {
+			t.Fatalf("invalid return:\nin:  %s\nwant: %s\ngot:  %s",
+				test.input,
+				test.output,
+				got,
+			)
+		}
+	}
+}
+
+func TestForbiddenLabels(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+		fail   bool
+	}{{
+		input:  `sum by (service) (foo)`,
+		output: `sum by (service) (foo{app="awesome"})`,
+	}, {
+		input:  `sum(foo)`,
+		output: `sum(foo{app="awesome"})`,
+	}, {
+		input:  `sum without (instance) (foo)`,
+		output: `sum without (instance, customer_id, user_email) (foo{app="awesome"})`,
+	}, {
+		input:  `max without (user_email) (foo)`,
+		output: `max without (user_email, customer_id) (foo{app="awesome"})`,
+	}, {
+		input:  `foo / ignoring (instance) bar`,
+		output: `foo{app="awesome"} / ignoring (instance) bar{app="awesome"}`,
+	}, {
+		input:  `foo * on (job) group_left (team) bar`,
+		output: `foo{app="awesome"} * on (job) group_left (team) bar{app="awesome"}`,
+	}, {
+		input:  `label_replace(foo, "dst", "$1", "src", "(.*)")`,
+		output: `label_replace(foo{app="awesome"}, "dst", "$1", "src", "(.*)")`,
+	}, {
+		input:  `label_join(foo, "dst", "customer_id", "a", "b")`,
+		output: `label_join(foo{app="awesome"}, "dst", "customer_id", "a", "b")`,
+	}, {
+		input:  `label_replace(foo, "dst", "customer_id", "src", "(.*)")`,
+		output: `label_replace(foo{app="awesome"}, "dst", "customer_id", "src", "(.*)")`,
+	}, {
+		input:  `label_replace(foo, "dst", "$1", "src", "customer_id")`,
+		output: `label_replace(foo{app="awesome"}, "dst", "$1", "src", "customer_id")`,
+	}, {
+		input: `sum by (customer_id) (foo)`,
+		fail:  true,
+	}, {
+		input: `count by (service, user_email) (foo)`,
+		fail:  true,
+	}, {
+		input: `foo * on (customer_id) bar`,
+		fail:  true,
+	}, {
+		input: `foo * on (job) group_left (customer_id) bar`,
+		fail:  true,
+	}, {
+		input: `foo * ignoring (job) group_right (user_email) bar`,
+		fail:  true,
+	}, {
+		input: `label_replace(foo, "dst", "$1", "customer_id", "(.*)")`,
+		fail:  true,
+	}, {
+		input: `label_replace(foo, "customer_id", "$1", "src", "(.*)")`,
+		fail:  true,
+	}, {
+		input: `label_join(foo, "dst", ",", "a", "user_email")`,
+		fail:  true,
+	}, {
+		input: `label_join(foo, "customer_id", ",", "a")`,
+		fail:  true,
+	}, {
+		input: `count_values("customer_id", foo)`,
+		fail:  true,
+	}, {
+		input: `foo{customer_id="1234"}`,
+		fail:  true,
+	}, {
+		input: `rate(foo{customer_id=~"1.*"}[5m])`,
+		fail:  true,
+	}}
+	for _, test := range tests {
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		labeled, err := l.AddLabels(parsed, aclMockForbidden{})
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("should be forbidden: %s: %v", test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		if got := labeled.String(); got != test.output {
+			t.Fatalf("invalid return:\nin:  %s\nwant: %s\ngot:  %s",
+				test.input,
+				test.output,
+				got,
+			)
+		}
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+		fail   bool
+	}{{
+		input:  `foo{client_ip="pseudo-1234"}`,
+		output: `foo{app="awesome",client_ip="10.0.0.1"}`,
+	}, {
+		input:  `sum by (client_ip) (foo{client_ip!="pseudo-1234"})`,
+		output: `sum by (client_ip) (foo{app="awesome",client_ip!="10.0.0.1"})`,
+	}, {
+		input:  `foo{user=""}`,
+		output: `foo{app="awesome",user=""}`,
+	}, {
+		input:  `label_replace(foo, "client_ip", "$1", "instance", "(.*)")`,
+		output: `label_replace(foo{app="awesome"}, "client_ip", "$1", "instance", "(.*)")`,
+	}, {
+		input: `foo{client_ip="10.0.0.1"}`,
+		fail:  true,
+	}, {
+		input: `foo{client_ip=~"10.*"}`,
+		fail:  true,
+	}, {
+		input: `foo{user="redacted"}`,
+		fail:  true,
+	}, {
+		input: `label_replace(foo, "dst", "$1", "client_ip", "(.*)")`,
+		fail:  true,
+	}, {
+		input: `label_join(foo, "dst", ",", "instance", "user")`,
+		fail:  true,
 	}}
+	l.SetPseudonymResolver(pseudonymMock{"client_ip/pseudo-1234": "10.0.0.1"})
+	defer l.SetPseudonymResolver(nil)
 	for _, test := range tests {
-		parsed, err := promql.ParseExpr(test.input)
-		if err != nil && !test.fail {
-			t.Fatalf("should not fail: %s", test.input)
-		}
-		if parsed != nil {
-			labeled := l.AddLabels(parsed, aclMockAwesome{})
-			if test.output != labeled.String() {
-				t.Fatalf(
-					"invalid return:\nin:  %s\nwant: %s\ngot:  %s",
-					test.input,
-					test.output,
-					labeled.String(),
-				)
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		labeled, err := l.AddLabels(parsed, aclMockRedacted{})
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("should be forbidden: %s: %v", test.input, err)
 			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		if got := labeled.String(); got != test.output {
+			t.Fatalf("invalid return:\nin:  %s\nwant: %s\ngot:  %s",
+				test.input,
+				test.output,
+				got,
+			)
+		}
+	}
+}
+
+func TestOwner(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+		fail   bool
+	}{{
+		input:  `container_cpu`,
+		output: `(container_cpu{app="awesome"} and on (namespace) kube_namespace_labels{label_team="payments"})`,
+	}, {
+		input:  `sum by (namespace) (container_cpu) * 2`,
+		output: `sum by (namespace) ((container_cpu{app="awesome"} and on (namespace) kube_namespace_labels{label_team="payments"})) * 2`,
+	}, {
+		input:  `container_cpu offset 1h / other`,
+		output: `(container_cpu{app="awesome"} offset 1h and on (namespace) kube_namespace_labels{label_team="payments"} offset 1h) / other{app="awesome"}`,
+	}, {
+		input:  `rate(container_cpu[5m])`,
+		output: `rate((container_cpu{app="awesome"} and on (namespace) kube_namespace_labels{label_team="payments"})[5m:])`,
+	}, {
+		input:  `rate(container_cpu[5m] @ end() offset 10m)`,
+		output: `rate((container_cpu{app="awesome"} and on (namespace) kube_namespace_labels{label_team="payments"})[5m:] @ end() offset 10m)`,
+	}, {
+		input:  `max_over_time(container_cpu[10m:1m])`,
+		output: `max_over_time((container_cpu{app="awesome"} and on (namespace) kube_namespace_labels{label_team="payments"})[10m:1m])`,
+	}, {
+		input:  `rate(other[5m])`,
+		output: `rate(other{app="awesome"}[5m])`,
+	}, {
+		input:  `{__name__="container_cpu"}`,
+		output: `({__name__="container_cpu",app="awesome"} and on (namespace) kube_namespace_labels{label_team="payments"})`,
+	}, {
+		input: `{__name__=~"container_.*"}`,
+		fail:  true,
+	}, {
+		input: `rate({namespace="default"}[5m])`,
+		fail:  true,
+	}}
+	for _, test := range tests {
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		labeled, err := l.AddLabels(parsed, aclMockOwner{})
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("should be forbidden: %s: %v", test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		got := labeled.String()
+		if got != test.output {
+			t.Fatalf("invalid return:\nin:  %s\nwant: %s\ngot:  %s",
+				test.input,
+				test.output,
+				got,
+			)
+		}
+		// the rewritten query has to be valid promql
+		if _, err := parser.ParseExpr(got); err != nil {
+			t.Fatalf("invalid query: %s: %s", got, err)
+		}
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		input    string
+		lookback time.Duration
+		fail     bool
+	}{{
+		input:    `foo`,
+		lookback: 5 * time.Minute,
+	}, {
+		input:    `rate(foo[1d] offset 1d)`,
+		lookback: 2 * 24 * time.Hour,
+	}, {
+		input:    `max_over_time(rate(foo[1h])[2d:5m] offset 1d)`,
+		lookback: 3*24*time.Hour + time.Hour,
+	}, {
+		input:    `rate(foo[1h] offset -2h)`,
+		lookback: 0,
+	}, {
+		input:    fmt.Sprintf(`rate(foo[1h] @ %d) + bar offset 1h`, now.Add(-time.Hour).Unix()),
+		lookback: time.Hour + 5*time.Minute,
+	}, {
+		input:    `rate(foo[5m] @ start())`,
+		lookback: 5 * time.Minute,
+	}, {
+		input: `rate(foo[8d])`,
+		fail:  true,
+	}, {
+		input: `foo offset 7d`,
+		fail:  true,
+	}, {
+		input: `max_over_time(rate(foo[1h])[6d:] offset 1d)`,
+		fail:  true,
+	}, {
+		input: fmt.Sprintf(`foo @ %d`, now.Add(-8*24*time.Hour).Unix()),
+		fail:  true,
+	}, {
+		input: fmt.Sprintf(`rate(foo[2d])[1d:] @ %d`, now.Add(-5*24*time.Hour).Unix()),
+		fail:  true,
+	}}
+	for _, test := range tests {
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		labeled, err := l.AddLabels(parsed, aclMockTime{})
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("should be forbidden: %s: %v", test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		if got := QueryLookback(labeled); got != test.lookback {
+			t.Fatalf("invalid lookback:\nin:  %s\nwant: %s\ngot:  %s", test.input, test.lookback, got)
+		}
+	}
+}
+
+func TestRestrictTimeRange(t *testing.T) {
+	now := time.Now()
+	notBefore := now.Add(-24 * time.Hour).Truncate(time.Second)
+	acl := aclMockTime{notBefore: notBefore}
+	tests := []struct {
+		endpoint string
+		params   url.Values
+		lookback time.Duration
+		want     url.Values
+		fail     bool
+	}{{
+		endpoint: "/api/v1/query",
+		params:   url.Values{},
+		want:     url.Values{},
+	}, {
+		endpoint: "/api/v1/query",
+		params:   url.Values{"time": {formatTime(notBefore.Add(time.Hour))}},
+		lookback: 2 * time.Hour,
+		fail:     true,
+	}, {
+		endpoint: "/api/v1/query_range",
+		params: url.Values{
+			"start": {formatTime(notBefore.Add(-time.Hour))},
+			"end":   {formatTime(now)},
+			"step":  {"25m"},
+		},
+		lookback: 30 * time.Minute,
+		want: url.Values{
+			"start": {formatTime(notBefore.Add(-time.Hour + 100*time.Minute))},
+			"end":   {formatTime(now)},
+			"step":  {"25m"},
+		},
+	}, {
+		endpoint: "/api/v1/query_range",
+		params: url.Values{
+			"start": {notBefore.Add(-2 * time.Hour).Format(time.RFC3339)},
+			"end":   {notBefore.Add(-time.Hour).Format(time.RFC3339)},
+			"step":  {"60"},
+		},
+		fail: true,
+	}, {
+		endpoint: "/api/v1/series",
+		params:   url.Values{"match[]": {"up"}},
+		want:     url.Values{"match[]": {"up"}, "start": {formatTime(notBefore)}},
+	}, {
+		endpoint: "/api/v1/labels",
+		params:   url.Values{"start": {formatTime(now.Add(-time.Hour))}},
+		want:     url.Values{"start": {formatTime(now.Add(-time.Hour))}},
+	}, {
+		endpoint: "/api/v1/label/job/values",
+		params:   url.Values{"end": {formatTime(notBefore.Add(-time.Second))}},
+		fail:     true,
+	}}
+	for _, test := range tests {
+		_, err := restrictTimeRange(&test.params, test.endpoint, test.lookback, acl)
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("should be forbidden: %s %v: %v", test.endpoint, test.params, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %s %v: %s", test.endpoint, test.params, err)
+		}
+		if got, want := test.params.Encode(), test.want.Encode(); got != want {
+			t.Fatalf("invalid params:\nendpoint: %s\nwant: %s\ngot:  %s", test.endpoint, want, got)
+		}
+	}
+}
+
+func TestMiddlewareTimeRange(t *testing.T) {
+	now := time.Now()
+	notBefore := now.Add(-24 * time.Hour).Truncate(time.Second)
+	acl := aclMockTime{notBefore: notBefore}
+	upstream, _ := url.Parse("http://prometheus:9090")
+	start := formatTime(notBefore.Add(-time.Hour))
+	clamped := formatTime(notBefore.Add(-time.Hour + 70*time.Minute))
+	query := url.Values{"query": {"up"}, "start": {start}, "end": {formatTime(now)}, "step": {"10m"}}
+
+	tests := []struct {
+		name   string
+		method string
+		url    url.Values
+		body   url.Values
+		code   int
+		query  url.Values
+		form   url.Values
+	}{{
+		name:   "get",
+		method: http.MethodGet,
+		url:    query,
+		code:   http.StatusOK,
+		query:  url.Values{"start": {clamped}},
+		form:   url.Values{},
+	}, {
+		name:   "post",
+		method: http.MethodPost,
+		body:   query,
+		code:   http.StatusOK,
+		query:  url.Values{},
+		form:   url.Values{"start": {clamped}},
+	}, {
+		name:   "post with start in url",
+		method: http.MethodPost,
+		url:    url.Values{"start": {start}},
+		body:   url.Values{"query": {"up"}, "end": {formatTime(now)}, "step": {"10m"}},
+		code:   http.StatusOK,
+		query:  url.Values{"start": {start}},
+		form:   url.Values{"start": {clamped}},
+	}, {
+		name:   "missing step",
+		method: http.MethodGet,
+		url:    url.Values{"query": {"up"}, "start": {start}, "end": {formatTime(now)}},
+		code:   http.StatusBadRequest,
+	}, {
+		name:   "invalid query",
+		method: http.MethodGet,
+		url:    url.Values{"query": {"up{"}, "start": {start}, "end": {formatTime(now)}, "step": {"10m"}},
+		code:   http.StatusBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got *http.Request
+			var gotBody string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				got, gotBody = r, string(body)
+			})
+			r := httptest.NewRequest(test.method, "/api/v1/query_range?"+test.url.Encode(), strings.NewReader(test.body.Encode()))
+			if test.body != nil {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			r = r.WithContext(context.WithValue(r.Context(), "acl", acl))
+			w := httptest.NewRecorder()
+			l.PromACLMiddlewareFor("test", upstream)(next).ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Fatalf("want %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			form, _ := url.ParseQuery(gotBody)
+			if start := got.URL.Query()["start"]; strings.Join(start, ",") != strings.Join(test.query["start"], ",") {
+				t.Errorf("invalid url start: want %v, got %v", test.query["start"], start)
+			}
+			if start := form["start"]; strings.Join(start, ",") != strings.Join(test.form["start"], ",") {
+				t.Errorf("invalid body start: want %v, got %v", test.form["start"], start)
+			}
+			if test.method == http.MethodGet && gotBody != "" {
+				t.Errorf("unexpected body for get request: %q", gotBody)
+			}
+		})
+	}
+}
+
+func TestForbiddenLabelValues(t *testing.T) {
+	upstream, _ := url.Parse("http://prometheus:9090")
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/api/v1/label/service/values", http.StatusOK},
+		{"/api/v1/label/customer_id/values", http.StatusForbidden},
+		{"/api/v1/label/user%5Femail/values", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), "acl", aclMockForbidden{}))
+		w := httptest.NewRecorder()
+		l.PromACLMiddlewareFor("test", upstream)(next).ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: want %d, got %d: %s", test.path, test.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		params   url.Values
+		fail     bool
+	}{{
+		endpoint: "/api/v1/query",
+		params:   url.Values{"query": {`sum(rate(foo[5m])) / sum(rate(bar[5m]))`}},
+	}, {
+		endpoint: "/api/v1/query_range",
+		params:   url.Values{"query": {`rate(foo[30d])`}, "start": {"0"}, "end": {"86400"}, "step": {"60"}},
+	}, {
+		endpoint: "/api/v1/query_range",
+		params:   url.Values{"query": {`max_over_time(rate(foo[5m])[1h:])`}, "start": {"0"}, "end": {"3600"}, "step": {"1m"}},
+	}, {
+		endpoint: "/api/v1/query",
+		params:   url.Values{"query": {`foo + bar + baz + qux`}},
+		fail:     true,
+	}, {
+		endpoint: "/api/v1/query",
+		params:   url.Values{"query": {`max_over_time(max_over_time(foo[5m:])[1h:])`}},
+		fail:     true,
+	}, {
+		endpoint: "/api/v1/query_range",
+		params:   url.Values{"query": {`rate(foo[30d])`}, "start": {"0"}, "end": {"7776000"}, "step": {"1h"}},
+		fail:     true,
+	}, {
+		endpoint: "/api/v1/query_range",
+		params:   url.Values{"query": {`rate(foo[30d])`}, "start": {"0"}, "end": {"3600"}, "step": {"15s"}},
+		fail:     true,
+	}, {
+		endpoint: "/api/v1/query_range",
+		params:   url.Values{"query": {`foo / bar`}, "start": {"0"}, "end": {"2592000"}, "step": {"60"}},
+		fail:     true,
+	}}
+	for _, test := range tests {
+		_, stats, err := l.labelize(&test.params, aclMockLimits{})
+		if err != nil {
+			t.Fatalf("should not fail: %v: %s", test.params, err)
+		}
+		err = checkLimits(&test.params, test.endpoint, stats, aclMockLimits{})
+		if test.fail {
+			if !errors.Is(err, ErrLimit) {
+				t.Fatalf("should exceed limits: %v: %v", test.params, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %v: %s", test.params, err)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		input string
+		acl   core.ACL
+		fail  bool
+	}{{
+		input: `sum(rate(foo[5m]))`,
+		acl:   aclMockFunctions{},
+	}, {
+		input: `quantile_over_time(0.9, foo[1h])`,
+		acl:   aclMockFunctions{},
+	}, {
+		input: `absent(foo)`,
+		acl:   aclMockFunctions{},
+	}, {
+		input: `sum(rate(foo[5m]))`,
+		acl:   aclMockAllowedFunctions{},
+	}, {
+		input: `label_replace(foo, "a", "$1", "b", "(.*)")`,
+		acl:   aclMockFunctions{},
+		fail:  true,
+	}, {
+		input: `count_values("value", foo)`,
+		acl:   aclMockFunctions{},
+		fail:  true,
+	}, {
+		input: `holt_winters(foo[1h], 0.5, 0.5)`,
+		acl:   aclMockFunctions{},
+		fail:  true,
+	}, {
+		input: `quantile_over_time(0.9, foo[1d])`,
+		acl:   aclMockFunctions{},
+		fail:  true,
+	}, {
+		input: `quantile_over_time(0.9, rate(foo[5m])[2h:])`,
+		acl:   aclMockFunctions{},
+		fail:  true,
+	}, {
+		input: `absent(secret)`,
+		acl:   aclMockFunctions{},
+		fail:  true,
+	}, {
+		input: `absent_over_time(secret{a="b"}[5m])`,
+		acl:   aclMockFunctions{},
+		fail:  true,
+	}, {
+		input: `max(rate(foo[5m]))`,
+		acl:   aclMockAllowedFunctions{},
+		fail:  true,
+	}, {
+		input: `sum(irate(foo[5m]))`,
+		acl:   aclMockAllowedFunctions{},
+		fail:  true,
+	}}
+	for _, test := range tests {
+		parsed, err := parser.ParseExpr(test.input)
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
+		}
+		_, err = l.AddLabels(parsed, test.acl)
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("should be forbidden: %s: %v", test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("should not fail: %s: %s", test.input, err)
 		}
 	}
 }
@@ -696,8 +1625,8 @@ func TestDedupe(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		parsed, _ := promql.ParseExpr(test.input)
-		parsed = l.AddLabels(parsed, aclMockNone{})
+		parsed, _ := parser.ParseExpr(test.input)
+		parsed, _ = l.AddLabels(parsed, aclMockNone{})
 		if got := parsed.String(); got != test.output {
 			t.Fatalf("invalid return:\nin:  %s\nwant: %s\ngot:  %s",
 				test.input,
@@ -707,3 +1636,123 @@ func TestDedupe(t *testing.T) {
 		}
 	}
 }
+
+type aclMockMatchers struct {
+	matchers string
+}
+
+func (am aclMockMatchers) GetLabelMatchers(string) []*labels.Matcher {
+	if am.matchers == "" {
+		return []*labels.Matcher{}
+	}
+	return MustParseLabels(am.matchers)
+}
+
+func TestNative(t *testing.T) {
+	tests := []struct {
+		matchers   string
+		extraLabel string
+		labelProxy string
+		fail       bool
+	}{{
+		matchers:   `namespace="a"`,
+		extraLabel: "extra_label=namespace%3Da",
+		labelProxy: "namespace=a",
+	}, {
+		matchers:   `namespace=~"a|b"`,
+		extraLabel: "extra_filters%5B%5D=%7Bnamespace%3D~%22a%7Cb%22%7D",
+		labelProxy: "namespace=a&namespace=b",
+	}, {
+		matchers:   `namespace="a",team!="c"`,
+		extraLabel: "extra_filters%5B%5D=%7Bteam%21%3D%22c%22%7D&extra_label=namespace%3Da",
+		fail:       true,
+	}, {
+		matchers:   `namespace=~"a.*"`,
+		extraLabel: "extra_filters%5B%5D=%7Bnamespace%3D~%22a.%2A%22%7D",
+		fail:       true,
+	}, {
+		matchers:   `team="c"`,
+		extraLabel: "extra_label=team%3Dc",
+		fail:       true,
+	}, {
+		matchers: "",
+		fail:     true,
+	}}
+	for _, test := range tests {
+		acl := aclMockMatchers{matchers: test.matchers}
+		params, err := extraLabels(acl)
+		if err != nil {
+			t.Fatalf("unable to enforce %s with extra_label: %s", test.matchers, err)
+		}
+		if got := params.Encode(); got != test.extraLabel {
+			t.Fatalf("invalid extra_label for %s:\nwant: %s\ngot:  %s", test.matchers, test.extraLabel, got)
+		}
+
+		params, err = labelProxyValues(acl, "namespace")
+		if test.fail {
+			if !errors.Is(err, ErrForbidden) {
+				t.Fatalf("prom-label-proxy must reject %s, got %v", test.matchers, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unable to enforce %s with prom-label-proxy: %s", test.matchers, err)
+		}
+		if got := params.Encode(); got != test.labelProxy {
+			t.Fatalf("invalid prom-label-proxy params for %s:\nwant: %s\ngot:  %s", test.matchers, test.labelProxy, got)
+		}
+	}
+}
+
+func TestNativeMiddleware(t *testing.T) {
+	upstream, _ := url.Parse("http://victoriametrics:8428")
+	acl := aclMockMatchers{matchers: `namespace="a"`}
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		query  string
+	}{
+		{http.MethodGet, "/api/v1/query?query=up&extra_label=namespace%3Db", http.StatusOK, "extra_label=namespace%3Da&query=up"},
+		{http.MethodPost, "/api/v1/series", http.StatusOK, "extra_label=namespace%3Da"},
+		{http.MethodGet, "/api/v1/status/buildinfo", http.StatusOK, ""},
+		{http.MethodGet, "/vmui/", http.StatusOK, ""},
+		{http.MethodGet, "/api/v1/export?match[]=up", http.StatusForbidden, ""},
+		{http.MethodGet, "/api/v1/export/native?match[]=up", http.StatusForbidden, ""},
+		{http.MethodGet, "/federate?match[]=up", http.StatusForbidden, ""},
+		{http.MethodGet, "/api/v1/query_exemplars?query=up", http.StatusForbidden, ""},
+		{http.MethodGet, "/api/v1/status/tsdb", http.StatusForbidden, ""},
+		{http.MethodGet, "/prometheus/api/v1/query?query=up", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		var got *http.Request
+		var gotBody string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			got, gotBody = r, string(body)
+		})
+		body := ""
+		if test.method == http.MethodPost {
+			body = "match%5B%5D=up"
+		}
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(body))
+		if body != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r = r.WithContext(context.WithValue(r.Context(), "acl", acl))
+		w := httptest.NewRecorder()
+		l.ExtraLabelMiddlewareFor("test", upstream)(next).ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Fatalf("%s %s: want %d, got %d: %s", test.method, test.path, test.code, w.Code, w.Body.String())
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if test.query != "" && got.URL.RawQuery != test.query {
+			t.Errorf("%s %s: invalid query:\nwant: %s\ngot:  %s", test.method, test.path, test.query, got.URL.RawQuery)
+		}
+		if gotBody != body {
+			t.Errorf("%s %s: invalid body: want %q, got %q", test.method, test.path, body, gotBody)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package labeler
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type (
+	// queryStats holds the properties of the queries of a request used to enforce the ACL
+	queryStats struct {
+		lookback      time.Duration
+		selectors     int
+		subqueryDepth int
+	}
+)
+
+// merge combines the stats of two parameter sets of the same request
+func (qs queryStats) merge(other queryStats) queryStats {
+	if other.lookback > qs.lookback {
+		qs.lookback = other.lookback
+	}
+	if other.selectors > qs.selectors {
+		qs.selectors = other.selectors
+	}
+	if other.subqueryDepth > qs.subqueryDepth {
+		qs.subqueryDepth = other.subqueryDepth
+	}
+	return qs
+}
+
+// queryComplexity counts the selectors and the maximum nesting of subqueries in expr
+func queryComplexity(expr parser.Expr) (selectors int, subqueryDepth int) {
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch node.(type) {
+		case *parser.VectorSelector:
+			selectors++
+		case *parser.SubqueryExpr:
+			depth := 1
+			for _, ancestor := range path {
+				if _, ok := ancestor.(*parser.SubqueryExpr); ok {
+					depth++
+				}
+			}
+			if depth > subqueryDepth {
+				subqueryDepth = depth
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// checkLimits rejects queries that exceed the core.Limits of the acl. The points of
+// a query are estimated by the number of steps times the number of selectors
+func checkLimits(params *url.Values, endpoint string, stats queryStats, acl core.ACL) error {
+	limitACL, ok := acl.(core.LimitACL)
+	if !ok {
+		return nil
+	}
+	limits := limitACL.GetLimits()
+	if limits.MaxSelectors > 0 && stats.selectors > limits.MaxSelectors {
+		return fmt.Errorf("%w: query has %d selectors, the maximum is %d",
+			ErrLimit, stats.selectors, limits.MaxSelectors)
+	}
+	if limits.MaxSubqueryDepth > 0 && stats.subqueryDepth > limits.MaxSubqueryDepth {
+		return fmt.Errorf("%w: query nests %d subqueries, the maximum is %d",
+			ErrLimit, stats.subqueryDepth, limits.MaxSubqueryDepth)
+	}
+
+	steps := int64(1)
+	switch endpoint {
+	case "/api/v1/query":
+	case "/api/v1/query_range":
+		if params.Get("query") == "" {
+			return nil
+		}
+		now := time.Now()
+		start, err := parseTimeParam(params, "start", now)
+		if err != nil {
+			return err
+		}
+		end, err := parseTimeParam(params, "end", now)
+		if err != nil {
+			return err
+		}
+		step, err := parseDurationParam(params, "step")
+		if err != nil {
+			return err
+		}
+		queryRange := end.Sub(start)
+		if limits.MaxRange > 0 && queryRange > limits.MaxRange {
+			return fmt.Errorf("%w: query range of %s exceeds the maximum of %s",
+				ErrLimit, model.Duration(queryRange), model.Duration(limits.MaxRange))
+		}
+		if limits.MinStep > 0 && step < limits.MinStep {
+			return fmt.Errorf("%w: query step of %s is below the minimum of %s",
+				ErrLimit, model.Duration(step), model.Duration(limits.MinStep))
+		}
+		steps = int64(queryRange/step) + 1
+	default:
+		return nil
+	}
+
+	points := steps * int64(stats.selectors)
+	if limits.MaxPoints > 0 && points > limits.MaxPoints {
+		return fmt.Errorf("%w: query is estimated to select %d points, the maximum is %d",
+			ErrLimit, points, limits.MaxPoints)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package labeler
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -8,23 +9,25 @@ import (
 	"strings"
 	"time"
 
-	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/bitsbeats/prometheus-acls/internal/core"
 	"github.com/bitsbeats/prometheus-acls/internal/prom"
 )
 
-// PromACLMiddlewareFor generates a Middleware for a URL that modifies Prometheus Queries
-// by injecting additional Labels. These labels are provided by a core.ACL interface via
-// the requests Context
-func (l *Labeler) PromACLMiddlewareFor(u *url.URL) func(http.Handler) http.Handler {
+// PromACLMiddlewareFor generates a Middleware for the URL of the upstream name that modifies
+// Prometheus Queries by injecting additional Labels. These labels are provided by a core.ACL
+// interface via the requests Context
+func (l *Labeler) PromACLMiddlewareFor(name string, u *url.URL) func(http.Handler) http.Handler {
+	promProxyHist := l.promProxyHist.WithLabelValues(name)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			modified := false
 			r.Host = u.Hostname()
 
-			if r.URL.EscapedPath() == "/api/v1/query" || r.URL.EscapedPath() == "/api/v1/query_range" || r.URL.EscapedPath() == "/api/v1/series" {
+			path := r.URL.EscapedPath()
+			if IsQueryPath(path) {
 				// lookup acl in context
 				acl, ok := r.Context().Value("acl").(core.ACL)
 				if !ok {
@@ -33,34 +36,66 @@ func (l *Labeler) PromACLMiddlewareFor(u *url.URL) func(http.Handler) http.Handl
 					return
 				}
 
+				err := checkLabelValuesPath(path, acl)
+				if err != nil {
+					sendQueryError(w, r, err)
+					return
+				}
+
 				// manipulate post parameters
-				err := r.ParseForm()
+				err = r.ParseForm()
 				if err != nil {
 					msg := fmt.Sprintf("unable to parse form: %s", err)
-					prom.SendError(w, r, msg, http.StatusInternalServerError, nil)
+					prom.SendError(w, r, msg, http.StatusBadRequest, nil)
 					return
 				}
-				subModified, err := l.labelize(&r.PostForm, acl)
+				subModified, postStats, err := l.labelize(&r.PostForm, acl)
 				if err != nil {
-					msg := fmt.Sprintf("unable to parse prometheus query: %s", err)
-					prom.SendError(w, r, msg, http.StatusInternalServerError, nil)
+					sendQueryError(w, r, err)
 					return
 				}
 				modified = modified || subModified
-				newBody := strings.NewReader(r.PostForm.Encode())
-				r.ContentLength = newBody.Size()
-				r.Body = ioutil.NopCloser(newBody)
 
 				// manipulate get parameters
 				getParams := r.URL.Query()
-				subModified, err = l.labelize(&getParams, acl)
+				subModified, getStats, err := l.labelize(&getParams, acl)
 				if err != nil {
-					msg := fmt.Sprintf("unable to parse prometheus query: %s", err)
-					prom.SendError(w, r, msg, http.StatusInternalServerError, nil)
+					sendQueryError(w, r, err)
 					return
 				}
 				modified = modified || subModified
 
+				// restrict time range and cost of the parameters Prometheus evaluates,
+				// the body takes precedence over the url
+				stats := postStats.merge(getStats)
+				params := formValues(r.PostForm, getParams)
+				subModified, err = restrictTimeRange(&params, path, stats.lookback, acl)
+				if err != nil {
+					sendQueryError(w, r, err)
+					return
+				}
+				if subModified {
+					// only the start is clamped
+					if len(r.PostForm) > 0 {
+						r.PostForm.Set("start", params.Get("start"))
+					} else {
+						getParams.Set("start", params.Get("start"))
+					}
+					modified = true
+				}
+				err = checkLimits(&params, path, stats, acl)
+				if err != nil {
+					sendQueryError(w, r, err)
+					return
+				}
+
+				// manipulate body
+				if r.Method == http.MethodPost {
+					newBody := strings.NewReader(r.PostForm.Encode())
+					r.ContentLength = newBody.Size()
+					r.Body = ioutil.NopCloser(newBody)
+				}
+
 				// manipulate url
 				r.URL, err = url.Parse(fmt.Sprintf(
 					"%s://%s%s?%s",
@@ -77,33 +112,49 @@ func (l *Labeler) PromACLMiddlewareFor(u *url.URL) func(http.Handler) http.Handl
 			// serve the request
 			start := time.Now()
 			next.ServeHTTP(w, r)
-			l.promProxyHist.Observe(time.Since(start).Seconds())
+			promProxyHist.Observe(time.Since(start).Seconds())
 
 			// log
 			log.WithFields(log.Fields{
 				"modified": modified,
 				"method":   r.Method,
+				"upstream": name,
 			}).Info(r.URL.String())
 		})
 	}
 }
 
-// labelize modifies a prometheus query to inject labels based on acl
-func (l *Labeler) labelize(params *url.Values, acl core.ACL) (modified bool, err error) {
+// labelize modifies a prometheus query to inject labels based on acl and returns the
+// queryStats of the query
+func (l *Labeler) labelize(params *url.Values, acl core.ACL) (modified bool, stats queryStats, err error) {
 	for key, value := range *params {
 		if key == "query" || key == "match[]" {
 			query := value[0]
 
 			start := time.Now()
-			expr, err := promql.ParseExpr(query)
+			expr, err := parser.ParseExpr(query)
 			l.queryParseHist.Observe(time.Since(start).Seconds())
 			if err != nil {
-				return false, err
+				return false, stats, fmt.Errorf("%w: %s", ErrBadData, err)
+			}
+
+			if key == "query" {
+				stats.selectors, stats.subqueryDepth = queryComplexity(expr)
 			}
 
 			start = time.Now()
-			labeled := l.AddLabels(expr, acl)
+			labeled, err := l.AddLabels(expr, acl)
 			l.labelerDurationHist.Observe(time.Since(start).Seconds())
+			if err != nil {
+				return false, stats, err
+			}
+			if _, ok := labeled.(*parser.VectorSelector); key == "match[]" && !ok {
+				return false, stats, fmt.Errorf("%w: %s can only be selected by query", ErrForbidden, query)
+			}
+
+			if key == "query" {
+				stats.lookback = QueryLookback(labeled)
+			}
 
 			labeledQuery := labeled.String()
 			(*params)[key] = []string{labeledQuery}
@@ -112,3 +163,44 @@ func (l *Labeler) labelize(params *url.Values, acl core.ACL) (modified bool, err
 	}
 	return
 }
+
+// sendQueryError sends an error returned by labelize with a matching status code
+func sendQueryError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrForbidden) {
+		prom.SendError(w, r, err.Error(), http.StatusForbidden, nil)
+		return
+	}
+	if errors.Is(err, ErrLimit) {
+		prom.SendError(w, r, err.Error(), http.StatusUnprocessableEntity, nil)
+		return
+	}
+	if errors.Is(err, ErrBadData) {
+		prom.SendError(w, r, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+	msg := fmt.Sprintf("unable to parse prometheus query: %s", err)
+	prom.SendError(w, r, msg, http.StatusInternalServerError, nil)
+}
+
+// formValues merges the body and url parameters of a request like Prometheus does,
+// parameters of the body take precedence
+func formValues(post url.Values, get url.Values) url.Values {
+	values := url.Values{}
+	for key, value := range get {
+		values[key] = value
+	}
+	for key, value := range post {
+		values[key] = value
+	}
+	return values
+}
+
+// IsQueryPath checks if path is an endpoint whose parameters are modified by the Labeler
+func IsQueryPath(path string) bool {
+	return path == "/api/v1/query" || path == "/api/v1/query_range" || path == "/api/v1/series" || isLabelsPath(path)
+}
+
+// isLabelsPath checks if path is the labels or a label values endpoint
+func isLabelsPath(path string) bool {
+	return path == "/api/v1/labels" || (strings.HasPrefix(path, "/api/v1/label/") && strings.HasSuffix(path, "/values"))
+}
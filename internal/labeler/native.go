@@ -0,0 +1,166 @@
+package labeler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+	"github.com/bitsbeats/prometheus-acls/internal/prom"
+)
+
+// WildcardMetric is the metric name of the rule that is enforced by upstreams with
+// native label enforcement
+const WildcardMetric = "*"
+
+type (
+	// enforceFunc returns the parameters that enforce the acl on an upstream
+	enforceFunc func(acl core.ACL) (url.Values, error)
+)
+
+// ExtraLabelMiddlewareFor generates a Middleware for the URL of the upstream name that
+// enforces the LabelMatchers of the WildcardMetric with the extra_label and extra_filters[]
+// parameters of VictoriaMetrics
+func (l *Labeler) ExtraLabelMiddlewareFor(name string, u *url.URL) func(http.Handler) http.Handler {
+	return l.nativeMiddlewareFor(name, u, []string{"extra_label", "extra_filters[]"}, extraLabels)
+}
+
+// LabelProxyMiddlewareFor generates a Middleware for the URL of the upstream name that
+// enforces the LabelMatchers of the WildcardMetric on label with the query parameter of
+// prom-label-proxy
+func (l *Labeler) LabelProxyMiddlewareFor(name string, u *url.URL, label string) func(http.Handler) http.Handler {
+	return l.nativeMiddlewareFor(name, u, []string{label}, func(acl core.ACL) (url.Values, error) {
+		return labelProxyValues(acl, label)
+	})
+}
+
+// nativeMiddlewareFor generates a Middleware that replaces the params of query requests
+// with the parameters returned by enforce
+func (l *Labeler) nativeMiddlewareFor(name string, u *url.URL, params []string, enforce enforceFunc) func(http.Handler) http.Handler {
+	promProxyHist := l.promProxyHist.WithLabelValues(name)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Host = u.Hostname()
+
+			path := r.URL.EscapedPath()
+			if !IsQueryPath(path) && isUnenforcedPath(path) {
+				msg := fmt.Sprintf("%s: %s can not be enforced by upstream %s", ErrForbidden, path, name)
+				prom.SendError(w, r, msg, http.StatusForbidden, nil)
+				return
+			}
+			if IsQueryPath(path) {
+				acl, ok := r.Context().Value("acl").(core.ACL)
+				if !ok {
+					msg := fmt.Sprintf("unable to load acl from context: not found")
+					prom.SendError(w, r, msg, http.StatusInternalServerError, nil)
+					return
+				}
+				enforced, err := enforce(acl)
+				if err != nil {
+					sendQueryError(w, r, err)
+					return
+				}
+
+				err = r.ParseForm()
+				if err != nil {
+					msg := fmt.Sprintf("unable to parse form: %s", err)
+					prom.SendError(w, r, msg, http.StatusInternalServerError, nil)
+					return
+				}
+				getParams := r.URL.Query()
+				for _, param := range params {
+					// parameters of the user are never forwarded
+					r.PostForm.Del(param)
+					getParams.Del(param)
+				}
+				for param, values := range enforced {
+					getParams[param] = values
+				}
+
+				if r.Method == http.MethodPost {
+					newBody := strings.NewReader(r.PostForm.Encode())
+					r.ContentLength = newBody.Size()
+					r.Body = ioutil.NopCloser(newBody)
+				}
+				r.URL.RawQuery = getParams.Encode()
+			}
+
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			promProxyHist.Observe(time.Since(start).Seconds())
+
+			log.WithFields(log.Fields{
+				"method":   r.Method,
+				"upstream": name,
+			}).Info(r.URL.String())
+		})
+	}
+}
+
+// isUnenforcedPath checks if path reads series that are not filtered by the native
+// enforcement, e.g. /api/v1/export, /federate or /api/v1/query_exemplars. The api is
+// also served below prefixes like /prometheus/api/v1/ by VictoriaMetrics
+func isUnenforcedPath(path string) bool {
+	if path == "/api/v1/status/buildinfo" {
+		return false
+	}
+	return strings.Contains(path, "/api/") || strings.Contains(path, "/federate") || strings.Contains(path, "/export")
+}
+
+// extraLabels converts the LabelMatchers of the WildcardMetric into extra_label parameters
+// for equality matchers and a extra_filters[] parameter for all other matchers
+func extraLabels(acl core.ACL) (url.Values, error) {
+	params := url.Values{}
+	filters := []*labels.Matcher{}
+	for _, matcher := range acl.GetLabelMatchers(WildcardMetric) {
+		if matcher.Type == labels.MatchEqual {
+			params.Add("extra_label", fmt.Sprintf("%s=%s", matcher.Name, matcher.Value))
+			continue
+		}
+		filters = append(filters, matcher)
+	}
+	if len(filters) > 0 {
+		params.Set("extra_filters[]", (&parser.VectorSelector{LabelMatchers: filters}).String())
+	}
+	return params, nil
+}
+
+// labelProxyValues converts the LabelMatchers of the WildcardMetric into the values of
+// label. Only equality matchers and regex matchers of alternations on label are supported
+func labelProxyValues(acl core.ACL, label string) (url.Values, error) {
+	params := url.Values{}
+	matchers := acl.GetLabelMatchers(WildcardMetric)
+	if len(matchers) > 1 {
+		return nil, fmt.Errorf("%w: unable to enforce multiple matchers with prom-label-proxy", ErrForbidden)
+	}
+	for _, matcher := range matchers {
+		if matcher.Name != label {
+			return nil, fmt.Errorf("%w: unable to enforce %s with prom-label-proxy", ErrForbidden, matcher)
+		}
+		switch matcher.Type {
+		case labels.MatchEqual:
+			params.Add(label, matcher.Value)
+		case labels.MatchRegexp:
+			values := matcher.SetMatches()
+			if len(values) == 0 {
+				return nil, fmt.Errorf("%w: unable to enforce %s with prom-label-proxy", ErrForbidden, matcher)
+			}
+			for _, value := range values {
+				params.Add(label, value)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unable to enforce %s with prom-label-proxy", ErrForbidden, matcher)
+		}
+	}
+	if len(params[label]) == 0 {
+		return nil, fmt.Errorf("%w: prom-label-proxy requires a value for %s", ErrForbidden, label)
+	}
+	return params, nil
+}
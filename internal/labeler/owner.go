@@ -0,0 +1,74 @@
+package labeler
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// joinOwner restricts an instant vector selector to the series of its owner:
+//
+//	selector and on(<owner.On>) owner_selector
+//
+// The owner selector uses the same offset and @ modifier as the selector
+func joinOwner(vs *parser.VectorSelector, acl core.ACL) parser.Expr {
+	owner, ok := getOwner(vs, acl)
+	if !ok {
+		return vs
+	}
+	ownerSelector := &parser.VectorSelector{
+		Name:           owner.Name,
+		LabelMatchers:  append([]*labels.Matcher{}, owner.LabelMatchers...),
+		OriginalOffset: vs.OriginalOffset,
+		Timestamp:      vs.Timestamp,
+		StartOrEnd:     vs.StartOrEnd,
+	}
+	return &parser.ParenExpr{
+		Expr: &parser.BinaryExpr{
+			Op:  parser.LAND,
+			LHS: vs,
+			RHS: ownerSelector,
+			VectorMatching: &parser.VectorMatching{
+				Card:           parser.CardManyToMany,
+				MatchingLabels: owner.On,
+				On:             true,
+			},
+		},
+	}
+}
+
+// joinOwnerRange restricts a range vector selector to the series of its owner. As
+// range vectors can not be joined the selector is converted into a subquery of the
+// joined instant vector selector:
+//
+//	(selector and on(<owner.On>) owner_selector)[<range>:]
+func joinOwnerRange(ms *parser.MatrixSelector, acl core.ACL) parser.Expr {
+	vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+	if !ok {
+		return ms
+	}
+	if _, ok := getOwner(vs, acl); !ok {
+		return ms
+	}
+	subquery := &parser.SubqueryExpr{
+		Range:          ms.Range,
+		OriginalOffset: vs.OriginalOffset,
+		Timestamp:      vs.Timestamp,
+		StartOrEnd:     vs.StartOrEnd,
+	}
+	// the modifiers are applied by the subquery
+	vs.OriginalOffset, vs.Timestamp, vs.StartOrEnd = 0, nil, 0
+	subquery.Expr = joinOwner(vs, acl)
+	return subquery
+}
+
+// getOwner loads the owner of the metric of vs if acl is a core.OwnerACL
+func getOwner(vs *parser.VectorSelector, acl core.ACL) (*core.Owner, bool) {
+	ownerACL, ok := acl.(core.OwnerACL)
+	if !ok {
+		return nil, false
+	}
+	name, _ := metricName(vs)
+	return ownerACL.GetOwner(name)
+}
@@ -0,0 +1,70 @@
+package labeler
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// SetPseudonymResolver configures the core.PseudonymResolver used to map pseudonyms
+// in label matchers back to their values
+func (l *Labeler) SetPseudonymResolver(resolver core.PseudonymResolver) {
+	l.pseudonyms = resolver
+}
+
+// resolveRedactions maps pseudonyms in label matchers back to their values and rejects
+// expressions that would reveal the values of redacted labels
+func (l *Labeler) resolveRedactions(expr parser.Expr, acl core.ACL) error {
+	redactionACL, ok := acl.(core.RedactionACL)
+	if !ok {
+		return nil
+	}
+	redactions := redactionACL.GetRedactions()
+	if len(redactions) == 0 {
+		return nil
+	}
+
+	switch casted := expr.(type) {
+	case *parser.VectorSelector:
+		for i, matcher := range casted.LabelMatchers {
+			redaction, ok := redactions[matcher.Name]
+			if !ok || matcher.Value == "" {
+				continue
+			}
+			if redaction.Action != core.RedactHMAC || (matcher.Type != labels.MatchEqual && matcher.Type != labels.MatchNotEqual) {
+				return fmt.Errorf("%w: label %s is redacted and may only be matched by pseudonym", ErrForbidden, matcher.Name)
+			}
+			value, ok := "", false
+			if l.pseudonyms != nil {
+				value, ok = l.pseudonyms.Resolve(matcher.Name, matcher.Value)
+			}
+			if !ok {
+				return fmt.Errorf("%w: unknown pseudonym %q for label %s, query the series again to resolve it", ErrForbidden, matcher.Value, matcher.Name)
+			}
+			resolved, err := labels.NewMatcher(matcher.Type, matcher.Name, value)
+			if err != nil {
+				return err
+			}
+			casted.LabelMatchers[i] = resolved
+		}
+	case *parser.Call:
+		sources := []parser.Expr{}
+		switch casted.Func.Name {
+		case "label_replace":
+			sources = casted.Args[3:4]
+		case "label_join":
+			sources = casted.Args[3:]
+		}
+		for _, source := range sources {
+			if label, ok := stringArg(source); ok {
+				if _, ok := redactions[label]; ok {
+					return fmt.Errorf("%w: label %s is redacted and may not be copied by %s", ErrForbidden, label, casted.Func.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package labeler
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// lookbackDelta is the default lookback of instant vector selectors in Prometheus
+const lookbackDelta = 5 * time.Minute
+
+// QueryLookback returns how far a query looks back from its evaluation time, selectors
+// with an absolute @ modifier are ignored
+func QueryLookback(expr parser.Expr) (lookback time.Duration) {
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		selectorLookback, at, ok := leafLookback(append(path, node))
+		if ok && at == nil && selectorLookback > lookback {
+			lookback = selectorLookback
+		}
+		return nil
+	})
+	return
+}
+
+// checkTimeRange rejects selectors that look back further than the maximum lookback or
+// access data before the earliest allowed time through an absolute @ modifier
+func checkTimeRange(path []parser.Node, acl core.ACL) error {
+	timeACL, ok := acl.(core.TimeACL)
+	if !ok {
+		return nil
+	}
+	maxLookback, _ := timeACL.GetTimeRestrictions()
+	notBefore, restricted := earliest(timeACL, time.Now())
+	if !restricted {
+		return nil
+	}
+	lookback, at, ok := leafLookback(path)
+	if !ok {
+		return nil
+	}
+	if at != nil {
+		if accessed := time.UnixMilli(*at).Add(-lookback); accessed.Before(notBefore) {
+			return fmt.Errorf("%w: query accesses data at %s, before the earliest allowed time %s",
+				ErrForbidden, accessed.UTC().Format(time.RFC3339), notBefore.UTC().Format(time.RFC3339))
+		}
+		return nil
+	}
+	if maxLookback > 0 && lookback > maxLookback {
+		return fmt.Errorf("%w: query looks back %s, more than the maximum lookback of %s",
+			ErrForbidden, model.Duration(lookback), model.Duration(maxLookback))
+	}
+	return nil
+}
+
+// leafLookback calculates the lookback of the selector at the end of path from its range,
+// offset and the ranges and offsets of all surrounding subqueries. If a selector or
+// subquery has an absolute @ modifier its timestamp in milliseconds is returned as at
+func leafLookback(path []parser.Node) (lookback time.Duration, at *int64, ok bool) {
+	i := len(path) - 1
+	switch casted := path[i].(type) {
+	case *parser.VectorSelector:
+		if _, ok := parent(path).(*parser.MatrixSelector); ok {
+			// handled by the MatrixSelector
+			return 0, nil, false
+		}
+		lookback = lookbackDelta + casted.OriginalOffset
+		at = casted.Timestamp
+	case *parser.MatrixSelector:
+		vs, ok := casted.VectorSelector.(*parser.VectorSelector)
+		if !ok {
+			return 0, nil, false
+		}
+		lookback = casted.Range + vs.OriginalOffset
+		at = vs.Timestamp
+	default:
+		return 0, nil, false
+	}
+	for i--; i >= 0 && at == nil; i-- {
+		subquery, ok := path[i].(*parser.SubqueryExpr)
+		if !ok {
+			continue
+		}
+		lookback += subquery.Range + subquery.OriginalOffset
+		at = subquery.Timestamp
+	}
+	if lookback < 0 {
+		lookback = 0
+	}
+	return lookback, at, true
+}
+
+// earliest returns the earliest time that may be queried at now
+func earliest(timeACL core.TimeACL, now time.Time) (notBefore time.Time, restricted bool) {
+	maxLookback, notBefore := timeACL.GetTimeRestrictions()
+	if maxLookback > 0 {
+		if lookbackStart := now.Add(-maxLookback); lookbackStart.After(notBefore) {
+			notBefore = lookbackStart
+		}
+	}
+	return notBefore, !notBefore.IsZero()
+}
+
+// restrictTimeRange clamps the start parameter of a request and rejects time and end
+// parameters that would access data before the earliest allowed time. The evaluation
+// of queries must start lookback after the earliest allowed time
+func restrictTimeRange(params *url.Values, endpoint string, lookback time.Duration, acl core.ACL) (modified bool, err error) {
+	timeACL, ok := acl.(core.TimeACL)
+	if !ok {
+		return false, nil
+	}
+	now := time.Now()
+	notBefore, restricted := earliest(timeACL, now)
+	if !restricted {
+		return false, nil
+	}
+	notBefore = notBefore.Add(lookback)
+
+	switch endpoint {
+	case "/api/v1/query":
+		evalTime, err := parseTimeParam(params, "time", now)
+		if err != nil {
+			return false, err
+		}
+		if evalTime.Before(notBefore) {
+			return false, timeRangeError("time", notBefore)
+		}
+	case "/api/v1/query_range":
+		start, err := parseTimeParam(params, "start", now)
+		if err != nil {
+			return false, err
+		}
+		end, err := parseTimeParam(params, "end", now)
+		if err != nil {
+			return false, err
+		}
+		if end.Before(notBefore) {
+			return false, timeRangeError("end", notBefore)
+		}
+		if start.Before(notBefore) {
+			step, err := parseDurationParam(params, "step")
+			if err != nil {
+				return false, err
+			}
+			// keep the start aligned to the steps of the original range
+			steps := math.Ceil(float64(notBefore.Sub(start)) / float64(step))
+			params.Set("start", formatTime(start.Add(time.Duration(steps)*step)))
+			modified = true
+		}
+	default:
+		start, err := parseTimeParam(params, "start", time.Time{})
+		if err != nil {
+			return false, err
+		}
+		end, err := parseTimeParam(params, "end", now)
+		if err != nil {
+			return false, err
+		}
+		if end.Before(notBefore) {
+			return false, timeRangeError("end", notBefore)
+		}
+		if start.Before(notBefore) {
+			params.Set("start", formatTime(notBefore))
+			modified = true
+		}
+	}
+	return
+}
+
+// timeRangeError creates the error for a parameter before the earliest allowed time
+func timeRangeError(param string, notBefore time.Time) error {
+	return fmt.Errorf("%w: %s must not be before %s", ErrForbidden, param, notBefore.UTC().Format(time.RFC3339))
+}
+
+// parseTimeParam parses a Prometheus API timestamp in unix seconds or RFC3339
+func parseTimeParam(params *url.Values, param string, defaultTime time.Time) (time.Time, error) {
+	value := params.Get(param)
+	if value == "" {
+		return defaultTime, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*float64(time.Second))), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: unable to parse %s %q: %s", ErrBadData, param, value, err)
+	}
+	return t, nil
+}
+
+// parseDurationParam parses a Prometheus API duration in seconds or as duration string
+func parseDurationParam(params *url.Values, param string) (time.Duration, error) {
+	value := params.Get(param)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: unable to parse %s %q: must be a positive duration", ErrBadData, param, value)
+	}
+	return time.Duration(d), nil
+}
+
+// formatTime formats t as Prometheus API timestamp in unix seconds
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', -1, 64)
+}
@@ -3,6 +3,7 @@ package prom
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -22,16 +23,17 @@ type (
 	NotPromHandlerFunc func(w http.ResponseWriter, r *http.Request, msg string, code int)
 )
 
-// SendError sends a Prometheus compatible error message and logs
+// SendError sends a Prometheus compatible error message for API requests and logs
 func SendError(w http.ResponseWriter, r *http.Request, msg string, code int, notPromHandler NotPromHandlerFunc) {
-	if r.URL.EscapedPath() == "/api/v1/query" || r.URL.EscapedPath() == "/api/v1/query_range" {
+	if strings.HasPrefix(r.URL.EscapedPath(), "/api/") {
 		p := Error{
 			Status:    "error",
 			Data:      map[string]interface{}{},
-			ErrorType: "server_error",
+			ErrorType: errorType(code),
 			Error:     msg,
 			Warnings:  []string{},
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(code)
 		err := json.NewEncoder(w).Encode(p)
 		if err != nil {
@@ -45,3 +47,18 @@ func SendError(w http.ResponseWriter, r *http.Request, msg string, code int, not
 		}
 	}
 }
+
+// errorType returns the Prometheus error type for a status code
+func errorType(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "bad_data"
+	case http.StatusUnprocessableEntity:
+		return "execution"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	return "server_error"
+}
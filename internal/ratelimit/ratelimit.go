@@ -0,0 +1,239 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+	"github.com/bitsbeats/prometheus-acls/internal/prom"
+)
+
+// idleTimeout is the time after which unused buckets are removed
+const idleTimeout = 10 * time.Minute
+
+var (
+	throttledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_acls_throttled_requests_total",
+		Help: "A Counter that tracks the requests rejected by rate or concurrency limits.",
+	}, []string{"scope", "reason"})
+	inFlightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_acls_in_flight_requests",
+		Help: "A Gauge that tracks the requests in flight that are subject to concurrency limits.",
+	}, []string{"scope"})
+)
+
+func init() {
+	prometheus.MustRegister(throttledCounter, inFlightGauge)
+}
+
+type (
+	// Limiter throttles requests to the Prometheus API per role and per subject
+	Limiter struct {
+		mutex   sync.Mutex
+		buckets map[string]*bucket
+	}
+
+	// bucket holds the token bucket and the requests in flight for a key
+	bucket struct {
+		limiter  *rate.Limiter
+		limit    core.RateLimit
+		inFlight int
+		lastSeen time.Time
+	}
+
+	// scope is a bucket a request is accounted to
+	scope struct {
+		name  string
+		key   string
+		limit core.RateLimit
+	}
+)
+
+// NewLimiter creates a new instance of *Limiter
+func NewLimiter() (l *Limiter) {
+	l = &Limiter{
+		buckets: map[string]*bucket{},
+	}
+
+	// bucket cleanup
+	tick := time.NewTicker(idleTimeout)
+	go func() {
+		for range tick.C {
+			l.cleanup()
+		}
+	}()
+	return
+}
+
+// Middleware throttles requests to the Prometheus API based on the core.RateLimitACL
+// provided via the requests Context
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.EscapedPath(), "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scopes := scopesFor(r.Context().Value("acl"))
+		if len(scopes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfter, reason, name := l.acquire(scopes)
+		if reason != "" {
+			throttledCounter.WithLabelValues(name, reason).Inc()
+			log.WithFields(log.Fields{
+				"scope":  name,
+				"reason": reason,
+			}).Info("throttled request")
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			msg := fmt.Sprintf("too many requests: %s limit of %s exceeded", reason, name)
+			prom.SendError(w, r, msg, http.StatusTooManyRequests, nil)
+			return
+		}
+		defer l.release(scopes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scopesFor returns the scopes of an acl that have a RateLimit configured
+func scopesFor(acl interface{}) (scopes []scope) {
+	limitACL, ok := acl.(core.RateLimitACL)
+	if !ok {
+		return nil
+	}
+	identity, ok := acl.(core.IdentityACL)
+	if !ok {
+		return nil
+	}
+	roleLimit, subjectLimit := limitACL.GetRateLimits()
+	role := identity.GetRole()
+	if subject := identity.GetSubject(); subject != "" && isLimited(subjectLimit) {
+		scopes = append(scopes, scope{
+			name:  "subject",
+			key:   fmt.Sprintf("subject:%s/%s", role, subject),
+			limit: subjectLimit,
+		})
+	}
+	if isLimited(roleLimit) {
+		scopes = append(scopes, scope{
+			name:  "role",
+			key:   fmt.Sprintf("role:%s", role),
+			limit: roleLimit,
+		})
+	}
+	return
+}
+
+// acquire takes a token and an in flight slot of all scopes. If a scope is
+// exhausted nothing is taken and the seconds to wait, the reason and the name
+// of the exhausted scope are returned
+func (l *Limiter) acquire(scopes []scope) (retryAfter int, reason string, name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	buckets := make([]*bucket, len(scopes))
+	for i, s := range scopes {
+		buckets[i] = l.bucket(s, now)
+		if s.limit.MaxInFlight > 0 && buckets[i].inFlight >= s.limit.MaxInFlight {
+			return 1, "concurrency", s.name
+		}
+	}
+
+	reservations := make([]*rate.Reservation, 0, len(scopes))
+	for i, s := range scopes {
+		if buckets[i].limiter == nil {
+			continue
+		}
+		reservation := buckets[i].limiter.ReserveN(now, 1)
+		reservations = append(reservations, reservation)
+		delay := reservation.DelayFrom(now)
+		if !reservation.OK() || delay > 0 {
+			for _, reservation := range reservations {
+				reservation.CancelAt(now)
+			}
+			return int(math.Max(1, math.Ceil(delay.Seconds()))), "rate", s.name
+		}
+	}
+
+	for i, s := range scopes {
+		if s.limit.MaxInFlight > 0 {
+			buckets[i].inFlight++
+			inFlightGauge.WithLabelValues(s.name).Inc()
+		}
+	}
+	return 0, "", ""
+}
+
+// release frees the in flight slots taken by acquire
+func (l *Limiter) release(scopes []scope) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for _, s := range scopes {
+		if s.limit.MaxInFlight > 0 {
+			l.bucket(s, now).inFlight--
+			inFlightGauge.WithLabelValues(s.name).Dec()
+		}
+	}
+}
+
+// bucket returns the bucket of a scope, it is recreated if the RateLimit changed
+func (l *Limiter) bucket(s scope, now time.Time) *bucket {
+	b, ok := l.buckets[s.key]
+	if !ok || b.limit != s.limit {
+		inFlight := 0
+		if ok {
+			inFlight = b.inFlight
+		}
+		b = &bucket{
+			limiter:  newTokenBucket(s.limit),
+			limit:    s.limit,
+			inFlight: inFlight,
+		}
+		l.buckets[s.key] = b
+	}
+	b.lastSeen = now
+	return b
+}
+
+// cleanup removes buckets that have not been used for idleTimeout
+func (l *Limiter) cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for key, b := range l.buckets {
+		if b.inFlight == 0 && time.Since(b.lastSeen) > idleTimeout {
+			log.Debugf("cleaning idle rate limit bucket for %s", key)
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// newTokenBucket creates the token bucket of a RateLimit, nil if requests are not rate limited
+func newTokenBucket(limit core.RateLimit) *rate.Limiter {
+	if limit.RequestsPerSecond <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, limit.RequestsPerSecond))
+	}
+	return rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), burst)
+}
+
+// isLimited checks if a RateLimit restricts requests at all
+func isLimited(limit core.RateLimit) bool {
+	return limit.RequestsPerSecond > 0 || limit.MaxInFlight > 0
+}
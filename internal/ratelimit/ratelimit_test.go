@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+type aclMockLimited struct {
+	subject string
+	role    core.RateLimit
+	user    core.RateLimit
+}
+
+func (am aclMockLimited) GetRole() string {
+	return "limited"
+}
+
+func (am aclMockLimited) GetSubject() string {
+	return am.subject
+}
+
+func (am aclMockLimited) GetRateLimits() (core.RateLimit, core.RateLimit) {
+	return am.role, am.user
+}
+
+func request(l *Limiter, acl interface{}, path string, next http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req = req.WithContext(context.WithValue(req.Context(), "acl", acl))
+	rec := httptest.NewRecorder()
+	l.Middleware(next).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimit(t *testing.T) {
+	l := NewLimiter()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	alice := aclMockLimited{subject: "alice", user: core.RateLimit{RequestsPerSecond: 0.01, Burst: 2}}
+	bob := aclMockLimited{subject: "bob", user: core.RateLimit{RequestsPerSecond: 0.01, Burst: 2}}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := request(l, alice, "/api/v1/query", ok)
+		if rec.Code != want {
+			t.Fatalf("request %d of alice: want %d, got %d", i, want, rec.Code)
+		}
+	}
+	rec := request(l, alice, "/api/v1/query", ok)
+	if retry := rec.Header().Get("Retry-After"); retry == "" || retry == "0" {
+		t.Fatalf("throttled request has invalid Retry-After %q", retry)
+	}
+	if rec := request(l, bob, "/api/v1/query", ok); rec.Code != http.StatusOK {
+		t.Fatalf("bob is throttled by the bucket of alice: got %d", rec.Code)
+	}
+	if rec := request(l, alice, "/metrics", ok); rec.Code != http.StatusOK {
+		t.Fatalf("non api request is throttled: got %d", rec.Code)
+	}
+
+	// the role bucket is shared by all subjects
+	carol := aclMockLimited{subject: "carol", role: core.RateLimit{RequestsPerSecond: 0.01, Burst: 1}}
+	dave := aclMockLimited{subject: "dave", role: carol.role}
+	if rec := request(l, carol, "/api/v1/query", ok); rec.Code != http.StatusOK {
+		t.Fatalf("first request of carol: got %d", rec.Code)
+	}
+	if rec := request(l, dave, "/api/v1/query", ok); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("role bucket is not shared: got %d", rec.Code)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	l := NewLimiter()
+	erin := aclMockLimited{subject: "erin", user: core.RateLimit{MaxInFlight: 1}}
+	var nested *httptest.ResponseRecorder
+	outer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nested = request(l, erin, "/api/v1/query", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	})
+	if rec := request(l, erin, "/api/v1/query", outer); rec.Code != http.StatusOK {
+		t.Fatalf("first request of erin: got %d", rec.Code)
+	}
+	if nested.Code != http.StatusTooManyRequests {
+		t.Fatalf("request exceeding max_in_flight: want %d, got %d", http.StatusTooManyRequests, nested.Code)
+	}
+	if rec := request(l, erin, "/api/v1/query", outer); rec.Code != http.StatusOK {
+		t.Fatalf("in flight slot is not released: got %d", rec.Code)
+	}
+}
@@ -0,0 +1,313 @@
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// PseudonymPrefix is prepended to all pseudonyms
+const PseudonymPrefix = "pseudo-"
+
+// maxPseudonyms is the number of pseudonyms kept per generation of the store, older
+// pseudonyms can not be resolved anymore
+const maxPseudonyms = 100000
+
+type (
+	// Redactor hides label values in Prometheus API responses and remembers the
+	// generated pseudonyms so they can be resolved in queries. The pseudonyms are
+	// kept in memory only and are not shared between instances
+	Redactor struct {
+		key []byte
+
+		mutex    sync.RWMutex
+		current  map[string]string
+		previous map[string]string
+
+		redactedCounter *prometheus.CounterVec
+	}
+
+	// bufferedWriter holds the response of the upstream until it is redacted
+	bufferedWriter struct {
+		header http.Header
+		code   int
+		body   bytes.Buffer
+	}
+)
+
+// NewRedactor creates a new instance of *Redactor with the HMAC key
+func NewRedactor(key []byte) (r *Redactor) {
+	r = &Redactor{
+		key:     key,
+		current: map[string]string{},
+		redactedCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_acls_redacted_responses_total",
+			Help: "A Counter that tracks the responses with redacted labels.",
+		}, []string{"endpoint"}),
+	}
+	prometheus.MustRegister(r.redactedCounter)
+	return
+}
+
+// Pseudonymize returns the HMAC pseudonym for the value of label
+func (r *Redactor) Pseudonymize(label string, value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	pseudonym := PseudonymPrefix + hex.EncodeToString(mac.Sum(nil)[:12])
+
+	key := label + "\x00" + pseudonym
+	r.mutex.RLock()
+	_, ok := r.current[key]
+	r.mutex.RUnlock()
+	if !ok {
+		r.mutex.Lock()
+		if len(r.current) >= maxPseudonyms {
+			// rotate the generations to keep the memory bounded
+			r.previous = r.current
+			r.current = map[string]string{}
+		}
+		r.current[key] = value
+		r.mutex.Unlock()
+	}
+	return pseudonym
+}
+
+// Resolve returns the value of label that has been replaced by pseudonym. HMACs can
+// not be reversed, ok is false for pseudonyms that were not issued by this Redactor
+// or have been rotated out of the store
+func (r *Redactor) Resolve(label string, pseudonym string) (value string, ok bool) {
+	key := label + "\x00" + pseudonym
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	value, ok = r.current[key]
+	if !ok {
+		value, ok = r.previous[key]
+	}
+	return
+}
+
+// Middleware redacts the labels of query, query_range, series, labels and label values
+// responses according to the core.RedactionACL in the requests Context. Forbidden
+// labels of a core.LabelACL are dropped from series and labels responses
+func (r *Redactor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		endpoint, label := endpointFor(req.URL.EscapedPath())
+		redactions := redactionsFor(req.Context().Value("acl"), endpoint)
+		if endpoint == "" || len(redactions) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// let the transport handle compression so the body can be parsed
+		req.Header.Del("Accept-Encoding")
+		buffered := &bufferedWriter{header: w.Header(), code: http.StatusOK}
+		next.ServeHTTP(buffered, req)
+
+		body := buffered.body.Bytes()
+		if buffered.code == http.StatusOK {
+			redacted, err := r.redactBody(body, endpoint, label, redactions)
+			if err != nil {
+				log.WithError(err).Error("unable to redact response")
+				http.Error(w, "unable to redact response", http.StatusBadGateway)
+				return
+			}
+			body = redacted
+			r.redactedCounter.WithLabelValues(endpoint).Inc()
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(buffered.code)
+		_, err := w.Write(body)
+		if err != nil {
+			log.WithError(err).Error("unable to send redacted response")
+		}
+	})
+}
+
+// redactionsFor returns the redactions of acl for endpoint, forbidden labels are
+// dropped from the series and labels endpoints
+func redactionsFor(acl interface{}, endpoint string) map[string]core.Redaction {
+	redactions := map[string]core.Redaction{}
+	if redactionACL, ok := acl.(core.RedactionACL); ok {
+		for label, redaction := range redactionACL.GetRedactions() {
+			redactions[label] = redaction
+		}
+	}
+	if labelACL, ok := acl.(core.LabelACL); ok && (endpoint == "series" || endpoint == "labels") {
+		for _, label := range labelACL.GetForbiddenLabels() {
+			redactions[label] = core.Redaction{Action: core.RedactDrop}
+		}
+	}
+	return redactions
+}
+
+// redactBody redacts a Prometheus API response body
+func (r *Redactor) redactBody(body []byte, endpoint string, label string, redactions map[string]core.Redaction) ([]byte, error) {
+	response := map[string]json.RawMessage{}
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := response["data"]
+	if !ok {
+		return body, nil
+	}
+
+	switch endpoint {
+	case "query", "query_range":
+		result := map[string]json.RawMessage{}
+		err = json.Unmarshal(data, &result)
+		if err != nil {
+			return nil, err
+		}
+		series := []map[string]json.RawMessage{}
+		if json.Unmarshal(result["result"], &series) != nil {
+			// scalar and string results have no labels
+			return body, nil
+		}
+		for _, sample := range series {
+			metric := map[string]string{}
+			err = json.Unmarshal(sample["metric"], &metric)
+			if err != nil {
+				return nil, err
+			}
+			sample["metric"], err = json.Marshal(r.redactLabels(metric, redactions))
+			if err != nil {
+				return nil, err
+			}
+		}
+		result["result"], err = json.Marshal(series)
+		if err != nil {
+			return nil, err
+		}
+		response["data"], err = json.Marshal(result)
+	case "series":
+		series := []map[string]string{}
+		err = json.Unmarshal(data, &series)
+		if err != nil {
+			return nil, err
+		}
+		for i, metric := range series {
+			series[i] = r.redactLabels(metric, redactions)
+		}
+		response["data"], err = json.Marshal(series)
+	case "values":
+		redaction, ok := redactions[label]
+		if !ok {
+			return body, nil
+		}
+		values := []string{}
+		err = json.Unmarshal(data, &values)
+		if err != nil {
+			return nil, err
+		}
+		response["data"], err = json.Marshal(r.redactValues(label, values, redaction))
+	case "labels":
+		names := []string{}
+		err = json.Unmarshal(data, &names)
+		if err != nil {
+			return nil, err
+		}
+		response["data"], err = json.Marshal(redactNames(names, redactions))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+// redactLabels applies the redactions to the labels of a series
+func (r *Redactor) redactLabels(metric map[string]string, redactions map[string]core.Redaction) map[string]string {
+	for label, value := range metric {
+		redaction, ok := redactions[label]
+		if !ok {
+			continue
+		}
+		switch redaction.Action {
+		case core.RedactDrop:
+			delete(metric, label)
+		case core.RedactReplace:
+			metric[label] = redaction.Replacement
+		case core.RedactHMAC:
+			metric[label] = r.Pseudonymize(label, value)
+		}
+	}
+	return metric
+}
+
+// redactValues applies the redaction to the values of a label
+func (r *Redactor) redactValues(label string, values []string, redaction core.Redaction) []string {
+	switch redaction.Action {
+	case core.RedactDrop:
+		return []string{}
+	case core.RedactReplace:
+		if len(values) == 0 {
+			return values
+		}
+		return []string{redaction.Replacement}
+	}
+	redacted := make([]string, 0, len(values))
+	for _, value := range values {
+		redacted = append(redacted, r.Pseudonymize(label, value))
+	}
+	return redacted
+}
+
+// redactNames removes the dropped labels from a list of label names
+func redactNames(names []string, redactions map[string]core.Redaction) []string {
+	redacted := make([]string, 0, len(names))
+	for _, name := range names {
+		if redaction, ok := redactions[name]; ok && redaction.Action == core.RedactDrop {
+			continue
+		}
+		redacted = append(redacted, name)
+	}
+	return redacted
+}
+
+// endpointFor returns the redacted endpoint for path and the label for label
+// values requests
+func endpointFor(path string) (endpoint string, label string) {
+	switch path {
+	case "/api/v1/query":
+		return "query", ""
+	case "/api/v1/query_range":
+		return "query_range", ""
+	case "/api/v1/series":
+		return "series", ""
+	case "/api/v1/labels":
+		return "labels", ""
+	}
+	if strings.HasPrefix(path, "/api/v1/label/") && strings.HasSuffix(path, "/values") {
+		label = strings.TrimSuffix(strings.TrimPrefix(path, "/api/v1/label/"), "/values")
+		return "values", label
+	}
+	return "", ""
+}
+
+// Header implements http.ResponseWriter
+func (b *bufferedWriter) Header() http.Header {
+	return b.header
+}
+
+// Write implements http.ResponseWriter
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// WriteHeader implements http.ResponseWriter
+func (b *bufferedWriter) WriteHeader(code int) {
+	b.code = code
+}
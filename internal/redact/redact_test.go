@@ -0,0 +1,126 @@
+package redact
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+var r = NewRedactor([]byte("secret"))
+
+type aclMockRedacted struct{}
+
+func (am aclMockRedacted) GetRedactions() map[string]core.Redaction {
+	return map[string]core.Redaction{
+		"client_ip": {Action: core.RedactHMAC},
+		"user":      {Action: core.RedactReplace, Replacement: "redacted"},
+		"token":     {Action: core.RedactDrop},
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	pseudonym := r.Pseudonymize("client_ip", "10.0.0.1")
+	tests := []struct {
+		path     string
+		upstream string
+		output   string
+	}{{
+		path:     "/api/v1/query",
+		upstream: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"client_ip":"10.0.0.1","job":"a","token":"x","user":"bob"},"value":[1,"1"]}]}}`,
+		output:   `{"data":{"result":[{"metric":{"client_ip":"` + pseudonym + `","job":"a","user":"redacted"},"value":[1,"1"]}],"resultType":"vector"},"status":"success"}`,
+	}, {
+		path:     "/api/v1/query_range",
+		upstream: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"token":"x"},"values":[[1,"1"]]}]}}`,
+		output:   `{"data":{"result":[{"metric":{},"values":[[1,"1"]]}],"resultType":"matrix"},"status":"success"}`,
+	}, {
+		path:     "/api/v1/query",
+		upstream: `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+		output:   `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+	}, {
+		path:     "/api/v1/series",
+		upstream: `{"status":"success","data":[{"__name__":"up","client_ip":"10.0.0.1"}]}`,
+		output:   `{"data":[{"__name__":"up","client_ip":"` + pseudonym + `"}],"status":"success"}`,
+	}, {
+		path:     "/api/v1/label/client_ip/values",
+		upstream: `{"status":"success","data":["10.0.0.1"]}`,
+		output:   `{"data":["` + pseudonym + `"],"status":"success"}`,
+	}, {
+		path:     "/api/v1/label/user/values",
+		upstream: `{"status":"success","data":["alice","bob"]}`,
+		output:   `{"data":["redacted"],"status":"success"}`,
+	}, {
+		path:     "/api/v1/label/token/values",
+		upstream: `{"status":"success","data":["x"]}`,
+		output:   `{"data":[],"status":"success"}`,
+	}, {
+		path:     "/api/v1/label/job/values",
+		upstream: `{"status":"success","data":["a"]}`,
+		output:   `{"status":"success","data":["a"]}`,
+	}, {
+		path:     "/api/v1/labels",
+		upstream: `{"status":"success","data":["client_ip","token"]}`,
+		output:   `{"data":["client_ip"],"status":"success"}`,
+	}}
+	for _, test := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(test.upstream))
+		})
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), "acl", aclMockRedacted{}))
+		rec := httptest.NewRecorder()
+		r.Middleware(upstream).ServeHTTP(rec, req)
+		if got := strings.TrimSpace(rec.Body.String()); got != test.output {
+			t.Fatalf("invalid return:\npath: %s\nwant: %s\ngot:  %s", test.path, test.output, got)
+		}
+	}
+
+	value, ok := r.Resolve("client_ip", pseudonym)
+	if !ok || value != "10.0.0.1" {
+		t.Fatalf("unable to resolve pseudonym %s: got %q", pseudonym, value)
+	}
+	if _, ok := r.Resolve("user", pseudonym); ok {
+		t.Fatalf("pseudonym %s must not resolve for another label", pseudonym)
+	}
+}
+
+type aclMockForbidden struct{}
+
+func (am aclMockForbidden) GetForbiddenLabels() []string {
+	return []string{"customer_id"}
+}
+
+func TestForbiddenLabels(t *testing.T) {
+	tests := []struct {
+		path     string
+		upstream string
+		output   string
+	}{{
+		path:     "/api/v1/series",
+		upstream: `{"status":"success","data":[{"__name__":"up","customer_id":"1234","job":"a"}]}`,
+		output:   `{"data":[{"__name__":"up","job":"a"}],"status":"success"}`,
+	}, {
+		path:     "/api/v1/labels",
+		upstream: `{"status":"success","data":["__name__","customer_id","job"]}`,
+		output:   `{"data":["__name__","job"],"status":"success"}`,
+	}, {
+		path:     "/api/v1/query",
+		upstream: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"customer_id":"1234"},"value":[1,"1"]}]}}`,
+		output:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"customer_id":"1234"},"value":[1,"1"]}]}}`,
+	}}
+	for _, test := range tests {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(test.upstream))
+		})
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), "acl", aclMockForbidden{}))
+		rec := httptest.NewRecorder()
+		r.Middleware(upstream).ServeHTTP(rec, req)
+		if got := strings.TrimSpace(rec.Body.String()); got != test.output {
+			t.Fatalf("invalid return:\npath: %s\nwant: %s\ngot:  %s", test.path, test.output, got)
+		}
+	}
+}
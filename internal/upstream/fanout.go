@@ -0,0 +1,302 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitsbeats/prometheus-acls/internal/labeler"
+	"github.com/bitsbeats/prometheus-acls/internal/prom"
+)
+
+type (
+	// Fanout sends queries to several upstreams in parallel and merges their responses.
+	// The series of each upstream are labeled with the name of the upstream
+	Fanout struct {
+		label   string
+		names   []string
+		members []http.Handler
+	}
+
+	// Member is an upstream of a Fanout
+	Member struct {
+		Name    string
+		Handler http.Handler
+	}
+
+	// memberResponse is the buffered response of a Member
+	memberResponse struct {
+		header http.Header
+		code   int
+		body   bytes.Buffer
+	}
+)
+
+// NewFanout creates a new instance of *Fanout that labels the series of its members
+// with label
+func NewFanout(label string, members []Member) (f *Fanout) {
+	f = &Fanout{label: label}
+	for _, member := range members {
+		f.names = append(f.names, member.Name)
+		f.members = append(f.members, member.Handler)
+	}
+	return
+}
+
+// ServeHTTP sends query, query_range, series and label requests to all members and
+// all other requests to the first member
+func (f *Fanout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	if !labeler.IsQueryPath(path) {
+		f.members[0].ServeHTTP(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		msg := fmt.Sprintf("unable to parse form: %s", err)
+		prom.SendError(w, r, msg, http.StatusBadRequest, nil)
+		return
+	}
+
+	responses := make([]*memberResponse, len(f.members))
+	wg := sync.WaitGroup{}
+	for i, member := range f.members {
+		out := r.Clone(r.Context())
+		out.Body = http.NoBody
+		// let the transport handle compression so the body can be parsed
+		out.Header.Del("Accept-Encoding")
+		responses[i] = &memberResponse{header: http.Header{}, code: http.StatusOK}
+		wg.Add(1)
+		go func(member http.Handler, out *http.Request, response *memberResponse) {
+			defer wg.Done()
+			member.ServeHTTP(response, out)
+		}(member, out, responses[i])
+	}
+	wg.Wait()
+
+	body, code, err := f.merge(path, responses)
+	if err != nil {
+		log.WithError(err).Error("unable to merge responses")
+		prom.SendError(w, r, "unable to merge responses", http.StatusBadGateway, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	_, err = w.Write(body)
+	if err != nil {
+		log.WithError(err).Error("unable to send merged response")
+	}
+}
+
+// merge merges the responses of the members. Failed members are reported as
+// warnings, if all members failed the first response is returned
+func (f *Fanout) merge(path string, responses []*memberResponse) (body []byte, code int, err error) {
+	var merged map[string]json.RawMessage
+	warnings := []string{}
+	for i, response := range responses {
+		decoded := map[string]json.RawMessage{}
+		if response.code != http.StatusOK || json.Unmarshal(response.body.Bytes(), &decoded) != nil {
+			warnings = append(warnings, fmt.Sprintf("upstream %s failed: %s", f.names[i], failure(response)))
+			continue
+		}
+		memberWarnings := []string{}
+		if raw, ok := decoded["warnings"]; ok {
+			_ = json.Unmarshal(raw, &memberWarnings)
+		}
+		for _, warning := range memberWarnings {
+			warnings = append(warnings, fmt.Sprintf("upstream %s: %s", f.names[i], warning))
+		}
+
+		data, err := f.labelData(path, f.names[i], decoded["data"])
+		if err != nil {
+			return nil, 0, err
+		}
+		if merged == nil {
+			merged = decoded
+			merged["data"] = data
+			continue
+		}
+		merged["data"], err = mergeData(path, merged["data"], data)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if merged == nil {
+		return responses[0].body.Bytes(), responses[0].code, nil
+	}
+
+	delete(merged, "warnings")
+	if len(warnings) > 0 {
+		merged["warnings"], err = json.Marshal(warnings)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	body, err = json.Marshal(merged)
+	return body, http.StatusOK, err
+}
+
+// labelData adds the label of the Fanout to the data of a member response
+func (f *Fanout) labelData(path string, name string, data json.RawMessage) (json.RawMessage, error) {
+	switch {
+	case path == "/api/v1/query" || path == "/api/v1/query_range":
+		result := map[string]json.RawMessage{}
+		err := json.Unmarshal(data, &result)
+		if err != nil {
+			return nil, err
+		}
+		series := []map[string]json.RawMessage{}
+		if json.Unmarshal(result["result"], &series) != nil {
+			// scalar and string results have no labels
+			return data, nil
+		}
+		for _, sample := range series {
+			metric := map[string]string{}
+			err = json.Unmarshal(sample["metric"], &metric)
+			if err != nil {
+				return nil, err
+			}
+			sample["metric"], err = json.Marshal(f.labelMetric(metric, name))
+			if err != nil {
+				return nil, err
+			}
+		}
+		result["result"], err = json.Marshal(series)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(result)
+	case path == "/api/v1/series":
+		series := []map[string]string{}
+		err := json.Unmarshal(data, &series)
+		if err != nil {
+			return nil, err
+		}
+		for i, metric := range series {
+			series[i] = f.labelMetric(metric, name)
+		}
+		return json.Marshal(series)
+	case path == "/api/v1/labels":
+		return mergeStrings(data, []string{f.label})
+	case path == "/api/v1/label/"+f.label+"/values":
+		return mergeStrings(data, []string{name})
+	}
+	return data, nil
+}
+
+// labelMetric adds the label of the Fanout to metric unless it is already set
+func (f *Fanout) labelMetric(metric map[string]string, name string) map[string]string {
+	if _, ok := metric[f.label]; !ok {
+		metric[f.label] = name
+	}
+	return metric
+}
+
+// mergeData merges the data of two labeled member responses
+func mergeData(path string, a json.RawMessage, b json.RawMessage) (json.RawMessage, error) {
+	if path == "/api/v1/query" || path == "/api/v1/query_range" {
+		resultA, resultB := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+		err := json.Unmarshal(a, &resultA)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, &resultB)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(resultA["resultType"], resultB["resultType"]) {
+			return nil, fmt.Errorf("unable to merge result types %s and %s", resultA["resultType"], resultB["resultType"])
+		}
+		resultType := ""
+		_ = json.Unmarshal(resultA["resultType"], &resultType)
+		if resultType != "vector" && resultType != "matrix" {
+			// scalar and string results are taken from the first upstream
+			return a, nil
+		}
+		seriesA, seriesB := []json.RawMessage{}, []json.RawMessage{}
+		err = json.Unmarshal(resultA["result"], &seriesA)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(resultB["result"], &seriesB)
+		if err != nil {
+			return nil, err
+		}
+		resultA["result"], err = json.Marshal(append(seriesA, seriesB...))
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resultA)
+	}
+	if strings.HasPrefix(path, "/api/v1/label") {
+		values := []string{}
+		err := json.Unmarshal(b, &values)
+		if err != nil {
+			return nil, err
+		}
+		return mergeStrings(a, values)
+	}
+	seriesA, seriesB := []json.RawMessage{}, []json.RawMessage{}
+	err := json.Unmarshal(a, &seriesA)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &seriesB)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(append(seriesA, seriesB...))
+}
+
+// mergeStrings returns the sorted union of a list of strings and values
+func mergeStrings(data json.RawMessage, values []string) (json.RawMessage, error) {
+	decoded := []string{}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, value := range append(decoded, values...) {
+		set[value] = true
+	}
+	merged := make([]string, 0, len(set))
+	for value := range set {
+		merged = append(merged, value)
+	}
+	sort.Strings(merged)
+	return json.Marshal(merged)
+}
+
+// failure describes the error of a failed member response
+func failure(response *memberResponse) string {
+	decoded := struct {
+		Error string `json:"error"`
+	}{}
+	if json.Unmarshal(response.body.Bytes(), &decoded) == nil && decoded.Error != "" {
+		return decoded.Error
+	}
+	return http.StatusText(response.code)
+}
+
+// Header implements http.ResponseWriter
+func (m *memberResponse) Header() http.Header {
+	return m.header
+}
+
+// Write implements http.ResponseWriter
+func (m *memberResponse) Write(b []byte) (int, error) {
+	return m.body.Write(b)
+}
+
+// WriteHeader implements http.ResponseWriter
+func (m *memberResponse) WriteHeader(code int) {
+	m.code = code
+}
@@ -0,0 +1,98 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func staticMember(name string, code int, body string) Member {
+	return Member{
+		Name: name,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("query") == "" && r.URL.EscapedPath() == "/api/v1/query" {
+				code, body = http.StatusBadRequest, `{"status":"error","errorType":"bad_data","error":"query missing"}`
+			}
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(body))
+		}),
+	}
+}
+
+func TestFanout(t *testing.T) {
+	tests := []struct {
+		path    string
+		members []Member
+		code    int
+		output  string
+	}{{
+		path: "/api/v1/query?query=up",
+		members: []Member{
+			staticMember("a", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"x"},"value":[1,"1"]}]}}`),
+			staticMember("b", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"x"},"value":[1,"0"]}]},"warnings":["slow"]}`),
+		},
+		code:   http.StatusOK,
+		output: `{"data":{"result":[{"metric":{"cluster":"a","job":"x"},"value":[1,"1"]},{"metric":{"cluster":"b","job":"x"},"value":[1,"0"]}],"resultType":"vector"},"status":"success","warnings":["upstream b: slow"]}`,
+	}, {
+		path: "/api/v1/query_range?query=up",
+		members: []Member{
+			staticMember("a", http.StatusOK, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"]]}]}}`),
+			staticMember("b", http.StatusServiceUnavailable, `{"status":"error","errorType":"unavailable","error":"down"}`),
+		},
+		code:   http.StatusOK,
+		output: `{"data":{"result":[{"metric":{"cluster":"a"},"values":[[1,"1"]]}],"resultType":"matrix"},"status":"success","warnings":["upstream b failed: down"]}`,
+	}, {
+		path: "/api/v1/query?query=1",
+		members: []Member{
+			staticMember("a", http.StatusOK, `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`),
+			staticMember("b", http.StatusOK, `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`),
+		},
+		code:   http.StatusOK,
+		output: `{"data":{"resultType":"scalar","result":[1,"1"]},"status":"success"}`,
+	}, {
+		path: "/api/v1/series?match[]=up",
+		members: []Member{
+			staticMember("a", http.StatusOK, `{"status":"success","data":[{"__name__":"up"}]}`),
+			staticMember("b", http.StatusOK, `{"status":"success","data":[{"__name__":"up","cluster":"c"}]}`),
+		},
+		code:   http.StatusOK,
+		output: `{"data":[{"__name__":"up","cluster":"a"},{"__name__":"up","cluster":"c"}],"status":"success"}`,
+	}, {
+		path: "/api/v1/labels",
+		members: []Member{
+			staticMember("a", http.StatusOK, `{"status":"success","data":["job"]}`),
+			staticMember("b", http.StatusOK, `{"status":"success","data":["instance","job"]}`),
+		},
+		code:   http.StatusOK,
+		output: `{"data":["cluster","instance","job"],"status":"success"}`,
+	}, {
+		path: "/api/v1/label/cluster/values",
+		members: []Member{
+			staticMember("a", http.StatusOK, `{"status":"success","data":[]}`),
+			staticMember("b", http.StatusOK, `{"status":"success","data":[]}`),
+		},
+		code:   http.StatusOK,
+		output: `{"data":["a","b"],"status":"success"}`,
+	}, {
+		path: "/api/v1/query",
+		members: []Member{
+			staticMember("a", http.StatusOK, ``),
+			staticMember("b", http.StatusOK, ``),
+		},
+		code:   http.StatusBadRequest,
+		output: `{"status":"error","errorType":"bad_data","error":"query missing"}`,
+	}}
+	for _, test := range tests {
+		f := NewFanout("cluster", test.members)
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Fatalf("invalid status for %s: want %d, got %d", test.path, test.code, rec.Code)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != test.output {
+			t.Fatalf("invalid return:\npath: %s\nwant: %s\ngot:  %s", test.path, test.output, got)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+	"github.com/bitsbeats/prometheus-acls/internal/labeler"
+)
+
+// DefaultHealthCheckInterval is the default interval of the active health checks
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// DefaultEjectDuration is the default duration a failed replica receives no requests
+const DefaultEjectDuration = 30 * time.Second
+
+// healthCheckTimeout is the timeout of a single health check
+const healthCheckTimeout = 5 * time.Second
+
+var (
+	replicaHealthyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_acls_upstream_replica_healthy",
+		Help: "A Gauge that tracks if a replica of an upstream receives requests.",
+	}, []string{"upstream", "replica"})
+	replicaRetriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_acls_upstream_retries_total",
+		Help: "A Counter that tracks the requests retried on another replica of an upstream.",
+	}, []string{"upstream"})
+)
+
+func init() {
+	prometheus.MustRegister(replicaHealthyGauge, replicaRetriesCounter)
+}
+
+type (
+	// Pool is a http.RoundTripper that balances requests over the replicas of an upstream
+	Pool struct {
+		name          string
+		replicas      []*replica
+		transport     http.RoundTripper
+		ejectDuration time.Duration
+
+		mutex sync.Mutex
+		next  int
+	}
+
+	// replica is a single Prometheus server of a Pool
+	replica struct {
+		url *url.URL
+
+		mutex        sync.Mutex
+		ready        bool
+		ejectedUntil time.Time
+	}
+)
+
+// NewPool creates a new instance of *Pool for the replicas of the upstream name. A zero
+// healthCheckInterval or ejectDuration uses the defaults
+func NewPool(name string, urls []*url.URL, transport http.RoundTripper, healthCheckInterval time.Duration, ejectDuration time.Duration) (p *Pool) {
+	if healthCheckInterval == 0 {
+		healthCheckInterval = DefaultHealthCheckInterval
+	}
+	if ejectDuration == 0 {
+		ejectDuration = DefaultEjectDuration
+	}
+	p = &Pool{
+		name:          name,
+		transport:     transport,
+		ejectDuration: ejectDuration,
+	}
+	for _, u := range urls {
+		p.replicas = append(p.replicas, &replica{url: u, ready: true})
+		replicaHealthyGauge.WithLabelValues(name, u.Host).Set(1)
+	}
+
+	if len(p.replicas) > 1 {
+		tick := time.NewTicker(healthCheckInterval)
+		go func() {
+			for range tick.C {
+				p.checkHealth()
+			}
+		}()
+	}
+	return
+}
+
+// Handler returns a reverse proxy to the replicas of the Pool
+func (p *Pool) Handler() http.Handler {
+	return &httputil.ReverseProxy{
+		// the replica is selected by RoundTrip
+		Director: func(r *http.Request) {
+			// the credentials of the user are not forwarded
+			r.Header.Del("Authorization")
+			setTenants(r)
+		},
+		Transport: p,
+	}
+}
+
+// RoundTrip sends the request to a replica. Idempotent requests are retried on the
+// next replica if a replica fails, other errors are returned unchanged
+func (p *Pool) RoundTrip(r *http.Request) (resp *http.Response, err error) {
+	replicas := p.order(r)
+	retry := isIdempotent(r) && len(replicas) > 1
+
+	var body []byte
+	if retry && r.Body != nil && r.Body != http.NoBody {
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, rep := range replicas {
+		out := r.Clone(r.Context())
+		out.URL.Scheme = rep.url.Scheme
+		out.URL.Host = rep.url.Host
+		out.URL.Path = joinPath(rep.url.Path, r.URL.Path)
+		out.URL.RawPath = ""
+		out.Host = rep.url.Host
+		if body != nil {
+			out.Body = ioutil.NopCloser(bytes.NewReader(body))
+			out.ContentLength = int64(len(body))
+		}
+
+		resp, err = p.transport.RoundTrip(out)
+		if !isReplicaFailure(resp, err) {
+			return resp, err
+		}
+		p.eject(rep, err, resp)
+		if !retry || i == len(replicas)-1 {
+			break
+		}
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		replicaRetriesCounter.WithLabelValues(p.name).Inc()
+	}
+	return resp, err
+}
+
+// isReplicaFailure checks if a replica is unreachable. Prometheus answers failed or
+// timed out queries with 500 and 503, these are not caused by the replica
+func isReplicaFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout
+}
+
+// order returns the replicas in the order they are tried for the request. Healthy
+// replicas come first, users are sticky to the same replica
+func (p *Pool) order(r *http.Request) []*replica {
+	replicas := make([]*replica, len(p.replicas))
+	copy(replicas, p.replicas)
+
+	subject := ""
+	if identity, ok := r.Context().Value("acl").(core.IdentityACL); ok {
+		subject = identity.GetSubject()
+	}
+	if subject != "" {
+		// rendezvous hashing keeps the replica of a user if others fail
+		weights := map[*replica]uint64{}
+		for _, rep := range replicas {
+			h := fnv.New64a()
+			h.Write([]byte(subject))
+			h.Write([]byte{0})
+			h.Write([]byte(rep.url.String()))
+			weights[rep] = h.Sum64()
+		}
+		sort.Slice(replicas, func(i, j int) bool {
+			return weights[replicas[i]] > weights[replicas[j]]
+		})
+	} else {
+		p.mutex.Lock()
+		offset := p.next % len(replicas)
+		p.next++
+		p.mutex.Unlock()
+		replicas = append(replicas[offset:], replicas[:offset]...)
+	}
+
+	now := time.Now()
+	available := map[*replica]bool{}
+	for _, rep := range replicas {
+		available[rep] = rep.available(now)
+	}
+	sort.SliceStable(replicas, func(i, j int) bool {
+		return available[replicas[i]] && !available[replicas[j]]
+	})
+	return replicas
+}
+
+// eject removes a failed replica from the Pool for the ejectDuration
+func (p *Pool) eject(rep *replica, err error, resp *http.Response) {
+	if len(p.replicas) < 2 {
+		return
+	}
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	} else {
+		reason = resp.Status
+	}
+	log.WithFields(log.Fields{
+		"upstream": p.name,
+		"replica":  rep.url.Host,
+		"reason":   reason,
+	}).Warn("ejecting upstream replica")
+	rep.mutex.Lock()
+	rep.ejectedUntil = time.Now().Add(p.ejectDuration)
+	rep.mutex.Unlock()
+	replicaHealthyGauge.WithLabelValues(p.name, rep.url.Host).Set(0)
+}
+
+// checkHealth queries the readiness endpoint of all replicas
+func (p *Pool) checkHealth() {
+	for _, rep := range p.replicas {
+		ready := p.ready(rep)
+		rep.mutex.Lock()
+		if ready != rep.ready {
+			log.WithFields(log.Fields{
+				"upstream": p.name,
+				"replica":  rep.url.Host,
+				"ready":    ready,
+			}).Info("upstream replica changed readiness")
+		}
+		rep.ready = ready
+		rep.mutex.Unlock()
+		healthy := 0.0
+		if rep.available(time.Now()) {
+			healthy = 1
+		}
+		replicaHealthyGauge.WithLabelValues(p.name, rep.url.Host).Set(healthy)
+	}
+}
+
+// ready checks if the readiness endpoint of a replica returns 200
+func (p *Pool) ready(rep *replica) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	u := *rep.url
+	u.Path = joinPath(u.Path, "/-/ready")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		log.WithError(err).WithField("replica", rep.url.Host).Debug("unable to check readiness")
+		return false
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// available checks if the replica is ready and not ejected
+func (rep *replica) available(now time.Time) bool {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	return rep.ready && now.After(rep.ejectedUntil)
+}
+
+// isIdempotent checks if a request may be sent to another replica
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		// queries are read only
+		return labeler.IsQueryPath(r.URL.EscapedPath())
+	}
+	return false
+}
+
+// joinPath joins the path of a replica with the path of a request
+func joinPath(base string, path string) string {
+	if base == "" {
+		return path
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(base, "/"), strings.TrimPrefix(path, "/"))
+}
@@ -0,0 +1,107 @@
+package upstream
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type aclMockIdentity struct {
+	subject string
+}
+
+func (am aclMockIdentity) GetRole() string {
+	return "developer"
+}
+
+func (am aclMockIdentity) GetSubject() string {
+	return am.subject
+}
+
+// replicaServer starts a replica that responds with its name and the request body
+func replicaServer(t *testing.T, name string, code *int) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(*code)
+		_, _ = w.Write([]byte(name + ":" + string(body)))
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return u
+}
+
+func poolRequest(p *Pool, method string, path string, body string, subject string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req = req.WithContext(context.WithValue(req.Context(), "acl", aclMockIdentity{subject: subject}))
+	rec := httptest.NewRecorder()
+	p.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPoolFailover(t *testing.T) {
+	codeA, codeB := http.StatusOK, http.StatusOK
+	a := replicaServer(t, "a", &codeA)
+	b := replicaServer(t, "b", &codeB)
+	p := NewPool("failover", []*url.URL{a, b}, http.DefaultTransport, 0, 0)
+
+	// users are sticky to a replica
+	first := poolRequest(p, http.MethodGet, "/api/v1/query?query=up", "", "alice").Body.String()
+	for i := 0; i < 5; i++ {
+		if got := poolRequest(p, http.MethodGet, "/api/v1/query?query=up", "", "alice").Body.String(); got != first {
+			t.Fatalf("user is not sticky: want %s, got %s", first, got)
+		}
+	}
+
+	// query errors and timeouts of Prometheus are not retried
+	failed := &codeB
+	if strings.HasPrefix(first, "a") {
+		failed = &codeA
+	}
+	for _, code := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		*failed = code
+		rec := poolRequest(p, http.MethodGet, "/api/v1/query?query=up", "", "alice")
+		if rec.Code != code || !strings.HasPrefix(rec.Body.String(), first[:1]) {
+			t.Fatalf("query error %d is retried: got %d %s", code, rec.Code, rec.Body.String())
+		}
+	}
+	*failed = http.StatusOK
+	if got := poolRequest(p, http.MethodGet, "/api/v1/query?query=up", "", "alice").Body.String(); got != first {
+		t.Fatalf("replica is ejected after query errors: got %s", got)
+	}
+
+	// queries are retried on the other replica
+	*failed = http.StatusBadGateway
+	rec := poolRequest(p, http.MethodPost, "/api/v1/query", "query=up", "alice")
+	if rec.Code != http.StatusOK || rec.Body.String() == first || !strings.HasSuffix(rec.Body.String(), ":query=up") {
+		t.Fatalf("query is not retried: got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the failed replica is ejected
+	codeA, codeB = http.StatusOK, http.StatusOK
+	if got := poolRequest(p, http.MethodGet, "/api/v1/query?query=up", "", "alice").Body.String(); got == first {
+		t.Fatalf("failed replica is not ejected: got %s", got)
+	}
+}
+
+func TestPoolNoRetry(t *testing.T) {
+	codeA, codeB := http.StatusBadGateway, http.StatusBadGateway
+	a := replicaServer(t, "a", &codeA)
+	b := replicaServer(t, "b", &codeB)
+	p := NewPool("noretry", []*url.URL{a, b}, http.DefaultTransport, 0, 0)
+
+	// writes are not retried
+	if rec := poolRequest(p, http.MethodPost, "/api/v1/admin/tsdb/snapshot", "", "bob"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("invalid status: want %d, got %d", http.StatusBadGateway, rec.Code)
+	}
+	// the last error is returned if all replicas fail
+	if rec := poolRequest(p, http.MethodGet, "/api/v1/query?query=up", "", "bob"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("invalid status: want %d, got %d", http.StatusBadGateway, rec.Code)
+	}
+}
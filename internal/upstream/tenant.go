@@ -0,0 +1,24 @@
+package upstream
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+)
+
+// TenantHeader is the header used by Cortex, Mimir and Thanos to select the tenant
+const TenantHeader = "X-Scope-OrgID"
+
+// setTenants replaces the tenant of the request with the tenants of the core.TenantACL
+// provided via the requests Context. Multiple tenants are joined for federated queries
+func setTenants(r *http.Request) {
+	r.Header.Del(TenantHeader)
+	acl, ok := r.Context().Value("acl").(core.TenantACL)
+	if !ok {
+		return
+	}
+	if tenants := acl.GetTenants(); len(tenants) > 0 {
+		r.Header.Set(TenantHeader, strings.Join(tenants, "|"))
+	}
+}
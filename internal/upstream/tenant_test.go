@@ -0,0 +1,53 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type aclMockTenants struct {
+	tenants []string
+}
+
+func (am aclMockTenants) GetTenants() []string {
+	return am.tenants
+}
+
+func TestTenants(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get(TenantHeader)))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	p := NewPool("tenants", []*url.URL{u}, http.DefaultTransport, 0, 0)
+
+	tests := []struct {
+		acl    interface{}
+		output string
+	}{{
+		acl:    aclMockTenants{tenants: []string{"team-a"}},
+		output: "team-a",
+	}, {
+		acl:    aclMockTenants{tenants: []string{"team-a", "team-b"}},
+		output: "team-a|team-b",
+	}, {
+		acl:    aclMockTenants{},
+		output: "",
+	}, {
+		acl:    nil,
+		output: "",
+	}}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set(TenantHeader, "admin")
+		req = req.WithContext(context.WithValue(req.Context(), "acl", test.acl))
+		rec := httptest.NewRecorder()
+		p.Handler().ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != test.output {
+			t.Fatalf("invalid tenant for %v: want %q, got %q", test.acl, test.output, got)
+		}
+	}
+}
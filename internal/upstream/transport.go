@@ -0,0 +1,133 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+)
+
+type (
+	// authTransport adds the credentials of an upstream to all requests
+	authTransport struct {
+		next http.RoundTripper
+
+		username    string
+		password    string
+		bearerToken *secretFile
+	}
+
+	// secretFile is a file holding a secret that is re-read when the file changes
+	secretFile struct {
+		path string
+
+		mutex   sync.Mutex
+		modTime time.Time
+		secret  string
+	}
+)
+
+// NewTransport creates the http.RoundTripper for the connection and the credentials
+// of an upstream
+func NewTransport(up *config.Upstream) (http.RoundTripper, error) {
+	tlsConfig, err := newTLSConfig(up.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure tls of upstream %s: %s", up.Name, err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	auth := &authTransport{next: transport}
+	if up.BasicAuth != nil {
+		auth.username = up.BasicAuth.Username
+		auth.password = up.BasicAuth.Password
+		if up.BasicAuth.PasswordFile != "" {
+			password, err := ioutil.ReadFile(up.BasicAuth.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read password of upstream %s: %s", up.Name, err)
+			}
+			auth.password = strings.TrimSpace(string(password))
+		}
+	}
+	if up.BearerTokenFile != "" {
+		auth.bearerToken = &secretFile{path: up.BearerTokenFile}
+		_, err = auth.bearerToken.get()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read bearer token of upstream %s: %s", up.Name, err)
+		}
+	}
+	return auth, nil
+}
+
+// newTLSConfig creates the tls.Config of an upstream
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// RoundTrip replaces the Authorization header of the request with the credentials
+// of the upstream
+func (a *authTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if a.username == "" && a.bearerToken == nil {
+		return a.next.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	if a.username != "" {
+		r.SetBasicAuth(a.username, a.password)
+	}
+	if a.bearerToken != nil {
+		token, err := a.bearerToken.get()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read bearer token: %s", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.next.RoundTrip(r)
+}
+
+// get returns the secret, the file is only read if it has been modified
+func (s *secretFile) get() (string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if info.ModTime().Equal(s.modTime) {
+		return s.secret, nil
+	}
+	secret, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	s.secret = strings.TrimSpace(string(secret))
+	s.modTime = info.ModTime()
+	return s.secret, nil
+}
@@ -0,0 +1,107 @@
+package upstream
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/prometheus-acls/internal/config"
+)
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		upstream *config.Upstream
+		rotate   string
+		output   string
+	}{{
+		name: "bearer",
+		upstream: &config.Upstream{
+			BearerTokenFile: tokenFile,
+			TLSConfig:       config.TLSConfig{CAFile: caFile},
+		},
+		output: "Bearer first",
+	}, {
+		// reuses the transport of the previous test
+		name:   "rotated",
+		rotate: "second",
+		output: "Bearer second",
+	}, {
+		name: "basic",
+		upstream: &config.Upstream{
+			BasicAuth: &config.BasicAuth{Username: "prometheus", Password: "secret"},
+			TLSConfig: config.TLSConfig{CAFile: caFile},
+		},
+		output: "Basic cHJvbWV0aGV1czpzZWNyZXQ=",
+	}, {
+		name: "stripped",
+		upstream: &config.Upstream{
+			TLSConfig: config.TLSConfig{CAFile: caFile},
+		},
+		output: "",
+	}}
+	var transport http.RoundTripper
+	for _, test := range tests {
+		if test.upstream != nil {
+			var err error
+			transport, err = NewTransport(test.upstream)
+			if err != nil {
+				t.Fatalf("unable to create transport for %s: %s", test.name, err)
+			}
+		}
+		if test.rotate != "" {
+			// ensure the modification time changes
+			if err := ioutil.WriteFile(tokenFile, []byte(test.rotate), 0600); err != nil {
+				t.Fatal(err)
+			}
+			later := time.Now().Add(time.Minute)
+			if err := os.Chtimes(tokenFile, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p := NewPool(test.name, []*url.URL{u}, transport, 0, 0)
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set("Authorization", "Bearer user-token")
+		rec := httptest.NewRecorder()
+		p.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("invalid status for %s: want %d, got %d", test.name, http.StatusOK, rec.Code)
+		}
+		if got := rec.Body.String(); got != test.output {
+			t.Fatalf("invalid authorization for %s: want %q, got %q", test.name, test.output, got)
+		}
+	}
+
+	// servers are verified with the system roots without a ca_file
+	transport, err := NewTransport(&config.Upstream{Name: "untrusted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatalf("untrusted upstream certificate is accepted")
+	}
+}
@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/bitsbeats/prometheus-acls/internal/core"
+	"github.com/bitsbeats/prometheus-acls/internal/labeler"
+	"github.com/bitsbeats/prometheus-acls/internal/prom"
+)
+
+type (
+	// Router routes requests to the upstream configured by the core.UpstreamACL
+	// provided via the requests Context
+	Router struct {
+		fallback  string
+		upstreams map[string]http.Handler
+	}
+)
+
+// NewRouter creates a new instance of *Router, requests without an upstream are
+// routed to fallback
+func NewRouter(fallback string) *Router {
+	return &Router{
+		fallback:  fallback,
+		upstreams: map[string]http.Handler{},
+	}
+}
+
+// Add registers the handler of the upstream name
+func (rt *Router) Add(name string, handler http.Handler) {
+	rt.upstreams[name] = handler
+}
+
+// ServeHTTP passes the request to the handler of its upstream
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, err := rt.route(r)
+	if err != nil {
+		prom.SendError(w, r, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+	handler, ok := rt.upstreams[name]
+	if !ok {
+		msg := fmt.Sprintf("unable to find upstream %s", name)
+		prom.SendError(w, r, msg, http.StatusInternalServerError, nil)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// route returns the name of the upstream for the request. Queries selecting metrics
+// from different upstreams are rejected
+func (rt *Router) route(r *http.Request) (name string, err error) {
+	acl, ok := r.Context().Value("acl").(core.UpstreamACL)
+	if !ok {
+		return rt.fallback, nil
+	}
+	if !labeler.IsQueryPath(r.URL.EscapedPath()) {
+		return acl.GetUpstream(""), nil
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		return "", fmt.Errorf("unable to parse form: %s", err)
+	}
+	names := map[string]bool{}
+	for _, key := range []string{"query", "match[]"} {
+		for _, query := range r.Form[key] {
+			metricNames, err := labeler.MetricNames(query)
+			if err != nil {
+				// invalid queries are rejected by the labeler
+				log.WithError(err).Debug("unable to route query")
+				continue
+			}
+			for _, metricName := range metricNames {
+				names[acl.GetUpstream(metricName)] = true
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	switch len(sorted) {
+	case 0:
+		return acl.GetUpstream(""), nil
+	case 1:
+		return sorted[0], nil
+	}
+	return "", fmt.Errorf("unable to route query: metrics are located on different upstreams %s", strings.Join(sorted, ", "))
+}
@@ -0,0 +1,106 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type aclMockRouted struct{}
+
+func (am aclMockRouted) GetUpstream(metricName string) string {
+	switch metricName {
+	case "node_load1", "node_load5":
+		return "infra"
+	case "http_requests_total":
+		return "apps"
+	}
+	return "default"
+}
+
+func TestRouter(t *testing.T) {
+	rt := NewRouter("default")
+	for _, name := range []string{"default", "infra", "apps"} {
+		name := name
+		rt.Add(name, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		params url.Values
+		acl    interface{}
+		code   int
+		output string
+	}{{
+		method: http.MethodGet,
+		path:   "/api/v1/query",
+		params: url.Values{"query": {"node_load1 / node_load5"}},
+		acl:    aclMockRouted{},
+		code:   http.StatusOK,
+		output: "infra",
+	}, {
+		method: http.MethodPost,
+		path:   "/api/v1/query_range",
+		params: url.Values{"query": {"rate(http_requests_total[5m])"}},
+		acl:    aclMockRouted{},
+		code:   http.StatusOK,
+		output: "apps",
+	}, {
+		method: http.MethodGet,
+		path:   "/api/v1/series",
+		params: url.Values{"match[]": {"node_load1"}},
+		acl:    aclMockRouted{},
+		code:   http.StatusOK,
+		output: "infra",
+	}, {
+		method: http.MethodGet,
+		path:   "/api/v1/query",
+		params: url.Values{"query": {"1 + 1"}},
+		acl:    aclMockRouted{},
+		code:   http.StatusOK,
+		output: "default",
+	}, {
+		method: http.MethodGet,
+		path:   "/api/v1/query",
+		params: url.Values{"query": {"node_load1 + http_requests_total"}},
+		acl:    aclMockRouted{},
+		code:   http.StatusBadRequest,
+	}, {
+		method: http.MethodGet,
+		path:   "/graph",
+		acl:    aclMockRouted{},
+		code:   http.StatusOK,
+		output: "default",
+	}, {
+		method: http.MethodGet,
+		path:   "/api/v1/query",
+		params: url.Values{"query": {"node_load1"}},
+		acl:    nil,
+		code:   http.StatusOK,
+		output: "default",
+	}}
+	for _, test := range tests {
+		var req *http.Request
+		if test.method == http.MethodPost {
+			req = httptest.NewRequest(test.method, test.path, strings.NewReader(test.params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(test.method, test.path+"?"+test.params.Encode(), nil)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "acl", test.acl))
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Fatalf("invalid status for %s %v: want %d, got %d", test.path, test.params, test.code, rec.Code)
+		}
+		if test.output != "" && rec.Body.String() != test.output {
+			t.Fatalf("invalid upstream for %s %v: want %s, got %s", test.path, test.params, test.output, rec.Body.String())
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -11,6 +11,9 @@ import (
 	"github.com/bitsbeats/prometheus-acls/internal/auth"
 	"github.com/bitsbeats/prometheus-acls/internal/config"
 	"github.com/bitsbeats/prometheus-acls/internal/labeler"
+	"github.com/bitsbeats/prometheus-acls/internal/ratelimit"
+	"github.com/bitsbeats/prometheus-acls/internal/redact"
+	"github.com/bitsbeats/prometheus-acls/internal/upstream"
 )
 
 func main() {
@@ -22,33 +25,85 @@ func main() {
 	// mux
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
 
 	// auth
 	a, err := auth.NewAuth(cfg, "/oauth/")
 	if err != nil {
 		log.WithError(err).Fatalf("unable to setup auth")
 	}
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		err := a.Health()
+		switch {
+		case errors.Is(err, auth.ErrUnavailable):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case err != nil:
+			// requests are still authenticated by other providers or with the last known keys
+			fmt.Fprintf(w, "auth degraded: %s\n", err)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
 	mux.HandleFunc("/oauth/login", a.LoginHandler)
 	mux.HandleFunc("/oauth/callback", a.CallbackHandler)
 
-	// reverse proxy
-	u, err := url.Parse(cfg.PrometheusURL)
-	if err != nil {
-		log.WithError(err).Fatalf("unable to parse prometheus url")
-	}
-	proxy := httputil.NewSingleHostReverseProxy(u)
+	// reverse proxies
 	l := labeler.NewLabeler()
-	promacl := l.PromACLMiddlewareFor(u)
+	router := upstream.NewRouter(config.DefaultUpstream)
+	handlers := map[string]http.Handler{}
+	for name, up := range cfg.Upstreams {
+		if len(up.Fanout) > 0 {
+			continue
+		}
+		transport, err := upstream.NewTransport(up)
+		if err != nil {
+			log.WithError(err).Fatalf("unable to setup upstream")
+		}
+		pool := upstream.NewPool(name, up.URLs, transport, up.HealthCheckInterval, up.EjectDuration)
+		var enforce func(http.Handler) http.Handler
+		switch up.Enforcement {
+		case config.EnforceExtraLabel:
+			enforce = l.ExtraLabelMiddlewareFor(name, up.URLs[0])
+		case config.EnforcePromLabelProxy:
+			enforce = l.LabelProxyMiddlewareFor(name, up.URLs[0], up.Label)
+		default:
+			enforce = l.PromACLMiddlewareFor(name, up.URLs[0])
+		}
+		handlers[name] = enforce(pool.Handler())
+	}
+	for name, up := range cfg.Upstreams {
+		if len(up.Fanout) > 0 {
+			members := []upstream.Member{}
+			for _, member := range up.Fanout {
+				members = append(members, upstream.Member{Name: member, Handler: handlers[member]})
+			}
+			router.Add(name, upstream.NewFanout(up.ExternalLabel, members))
+			continue
+		}
+		router.Add(name, handlers[name])
+	}
+
+	// redaction
+	red := redact.NewRedactor(cfg.RedactionKey)
+	l.SetPseudonymResolver(red)
 
-	// authprotect -> acls -> prometheus
-	mux.Handle("/", a.Middleware(promacl(proxy)))
+	// rate limits
+	limiter := ratelimit.NewLimiter()
+
+	// authprotect -> rate limits -> redaction -> routing -> acls -> prometheus
+	mux.Handle("/", a.Middleware(limiter.Middleware(red.Middleware(router))))
 
 	// serve
 	log.WithField("listen", cfg.Listen).Info("listening")
-	err = http.ListenAndServe(cfg.Listen, mux)
+	if cfg.TLSCertFile != "" {
+		server := &http.Server{Addr: cfg.Listen, Handler: mux}
+		server.TLSConfig, err = auth.NewServerTLSConfig(cfg)
+		if err != nil {
+			log.WithError(err).Fatalf("unable to setup tls")
+		}
+		err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		err = http.ListenAndServe(cfg.Listen, mux)
+	}
 	if err != nil {
 		log.WithError(err).Fatalf("unable to start webserver")
 	}